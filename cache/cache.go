@@ -1,41 +1,102 @@
 package cache
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
+	"marwan.io/golist/crash"
 	"marwan.io/golist/driver"
+	"marwan.io/golist/events"
 	"marwan.io/golist/hash"
+	"marwan.io/golist/logging"
+	"marwan.io/golist/metrics"
+	"marwan.io/golist/sched"
 )
 
-var bname = []byte("driver")
+var (
+	bname = []byte("driver")
+	mname = []byte("meta")
+)
+
+var (
+	hits         = metrics.NewCounter("golist_cache_hits_total", "Requests served from the cache.")
+	misses       = metrics.NewCounter("golist_cache_misses_total", "Requests that ran go list because their entry was missing or unverified.")
+	listDuration = metrics.NewHistogram("golist_go_list_duration_seconds", "Duration of go list runs.", metrics.DurationBuckets)
+)
+
+func init() {
+	metrics.NewGaugeFunc("golist_cache_hit_ratio", "Share of requests served from the cache.", func() float64 {
+		h, m := hits.Value(), misses.Value()
+		if h+m == 0 {
+			return 0
+		}
+		return h / (h + m)
+	})
+}
+
+// Options configures the cache.
+type Options struct {
+	// Events receives the changes of cache entries. It may be nil.
+	Events *events.Bus
+	// Scheduler runs the go commands of the cache. It may be nil.
+	// Runs are in the background lane unless the context passed
+	// to the cache sets another priority.
+	Scheduler *sched.Scheduler
+	// GoTimeout is how long a single go command may run before
+	// it is killed. Zero means the driver's default.
+	GoTimeout time.Duration
+	// MaxEntries is the most entries the cache keeps. Beyond it,
+	// the entries that were used the longest ago are evicted.
+	// Zero means no limit.
+	MaxEntries int
+}
 
 // New returns a new DB interface, implemented by boltDB.
-func New(path string, lggr *logrus.Logger) (Service, error) {
+func New(path string, lggr *logrus.Logger, opts Options) (Service, error) {
 	// TODO: By the time we get here, this shouldn't time out.
-	db, err := bolt.Open(path, 0660, &bolt.Options{
+	db, err := bolt.Open(path, 0600, &bolt.Options{
 		Timeout: time.Second * 5,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("could not open DB: %v", err)
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(bname)
-		return err
+		for _, name := range [][]byte{bname, mname} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("could not create driver bucket: %v", err)
+		return nil, fmt.Errorf("could not create buckets: %v", err)
 	}
 	if lggr == nil {
 		lggr = logrus.New()
 		lggr.SetLevel(logrus.DebugLevel)
 	}
 
-	return &service{db: db, lggr: lggr}, nil
+	return &service{
+		db:         db,
+		lggr:       lggr,
+		events:     opts.Events,
+		sched:      opts.Scheduler,
+		goTimeout:  opts.GoTimeout,
+		maxEntries: opts.MaxEntries,
+		gens:       map[string]uint64{},
+		listing:    map[string]int{},
+		runs:       map[*Run]bool{},
+		calls:      map[string]*call{},
+	}, nil
 }
 
 // Service abstracts a way to cache go/packages results
@@ -43,104 +104,793 @@ type Service interface {
 	Get(ctx context.Context, cfg *driver.Config) ([]byte, error)
 	Update(ctx context.Context, cfg *driver.Config) error
 	UpdateAll(ctx context.Context) error
+	// UpdateMatching re-runs the driver for every watched
+	// cached config for which match returns true. The unwatched
+	// ones are marked unverified instead, so that they are
+	// listed again by the next Get rather than in the background.
+	UpdateMatching(ctx context.Context, match func(cfg *driver.Config) bool) error
+	// SetWatch records that cfg is being watched until deadline
+	// so that the watcher can be restored after a restart.
+	// A zero deadline removes the registration.
+	SetWatch(cfg *driver.Config, deadline time.Time) error
+	// Watches returns the persisted watch registrations
+	// of the entries that are still in the cache.
+	Watches() ([]Watch, error)
+	// MarkUnverified flags the entry of cfg as possibly stale,
+	// for example because nothing is watching it anymore.
+	// The next Get re-runs the driver instead of serving it.
+	MarkUnverified(cfg *driver.Config, inv Invalidation) error
+	// Changed records that files watched for cfg changed,
+	// so that go list runs of cfg in flight are not trusted.
+	Changed(cfg *driver.Config, inv Invalidation)
+	// Explain describes the entry of cfg and
+	// why it was last invalidated.
+	Explain(cfg *driver.Config) (Explanation, error)
+	// Stats describes the database and the go list runs in flight.
+	Stats() (Stats, error)
+	// Entries lists the cached configs
+	// and the directories of their packages.
+	Entries() ([]Entry, error)
+	// Delete drops the entry of cfg.
+	Delete(cfg *driver.Config) error
+	// Drain refuses new go list runs and waits until the ones
+	// in flight are done. Once ctx is done, it cancels them.
+	Drain(ctx context.Context) error
 	Close() error
 }
 
+// Entry is a cached config.
+type Entry struct {
+	Config *driver.Config
+	// Dirs are the directories of the listed packages.
+	Dirs []string
+}
+
+// Stats describes the state of the cache.
+type Stats struct {
+	Path    string
+	Size    int64
+	Entries int
+	Runs    []Run
+}
+
+// Run is a go list run in flight.
+type Run struct {
+	Patterns []string
+	Dir      string
+	Started  time.Time
+
+	cancel context.CancelFunc
+}
+
+// Outcome is how Get served a request.
+type Outcome string
+
+// Outcomes of Get.
+const (
+	// Hit means the response was served from the cache.
+	Hit Outcome = "hit"
+	// Miss means the entry was not cached and go list ran.
+	Miss Outcome = "miss"
+	// Stale means the entry was cached but unverified,
+	// so go list ran again.
+	Stale Outcome = "stale"
+	// Coalesced means the request waited for the go list
+	// run of another request for the same entry.
+	Coalesced Outcome = "coalesced"
+	// Bypass means the request had an overlay,
+	// which is never cached.
+	Bypass Outcome = "bypass"
+)
+
+type outcomeKey struct{}
+
+// WithOutcome returns a context in which Get
+// calls record with how it served the request.
+func WithOutcome(ctx context.Context, record func(Outcome)) context.Context {
+	return context.WithValue(ctx, outcomeKey{}, record)
+}
+
+func reportOutcome(ctx context.Context, o Outcome) {
+	if record, ok := ctx.Value(outcomeKey{}).(func(Outcome)); ok {
+		record(o)
+	}
+}
+
+// Reason is why an entry was invalidated.
+type Reason string
+
+// Reasons for invalidating an entry.
+const (
+	// FileChanged means a Go file of the entry changed.
+	FileChanged Reason = "file_changed"
+	// ModuleChanged means a go.mod or go.sum file changed.
+	ModuleChanged Reason = "module_changed"
+	// WatchExpired means nothing watches the entry anymore.
+	WatchExpired Reason = "watch_expired"
+	// Invalidated means the entry was invalidated explicitly.
+	Invalidated Reason = "invalidated"
+)
+
+// Invalidation records why and when an entry was invalidated.
+type Invalidation struct {
+	Reason Reason    `json:"reason"`
+	Time   time.Time `json:"time"`
+	// Path and Op are the file whose change invalidated
+	// the entry and what happened to it, e.g. WRITE.
+	Path string `json:"path,omitempty"`
+	Op   string `json:"op,omitempty"`
+	// RequestID is the ID of the request
+	// that invalidated the entry explicitly.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Explanation describes a cache entry.
+type Explanation struct {
+	Cached        bool
+	Unverified    bool
+	WatchDeadline time.Time
+	// LastInvalidation is nil if the entry
+	// was never invalidated.
+	LastInvalidation *Invalidation
+}
+
+// Watch is a persisted watch registration.
+type Watch struct {
+	Config   *driver.Config
+	Deadline time.Time
+}
+
+// meta is the bookkeeping stored alongside a cached response,
+// under the same key in the meta bucket.
+type meta struct {
+	WatchDeadline    time.Time     `json:"watch_deadline,omitempty"`
+	Unverified       bool          `json:"unverified,omitempty"`
+	LastInvalidation *Invalidation `json:"last_invalidation,omitempty"`
+	// LastUsed is when the entry was last listed or served,
+	// to within lastUsedPrecision. Eviction goes by it.
+	LastUsed time.Time `json:"last_used,omitempty"`
+}
+
+// lastUsedPrecision is how stale the LastUsed of an entry
+// may get, so that cache hits rarely need a write.
+const lastUsedPrecision = time.Minute
+
 type service struct {
-	db   *bolt.DB
-	lggr *logrus.Logger
+	db         *bolt.DB
+	lggr       *logrus.Logger
+	events     *events.Bus
+	sched      *sched.Scheduler
+	goTimeout  time.Duration
+	maxEntries int
+
+	mu sync.Mutex
+	// gens counts the changes to the files of each key listed,
+	// so that a go list run can tell whether the tree changed
+	// under it.
+	gens map[string]uint64
+	// listing counts the lists of each key in flight.
+	listing map[string]int
+	// runs are the go list runs in flight.
+	runs map[*Run]bool
+	// draining is set once no new runs may start.
+	draining bool
+	// calls are the Gets running go list, by key.
+	calls map[string]*call
+}
+
+// call is a Get running go list, whose
+// result other Gets of its key can share.
+type call struct {
+	done chan struct{}
+	bts  []byte
+	err  error
 }
 
+// maxRetries is how many times a go list run is repeated
+// when the files of its config change while it runs.
+const maxRetries = 2
+
 func (c *service) Get(ctx context.Context, cfg *driver.Config) ([]byte, error) {
+	lggr := logging.From(ctx, c.lggr)
+	if len(cfg.Overlay) > 0 {
+		// Overlays hold unsaved editor buffers,
+		// so their results are never cached.
+		lggr.Debugf("%v has an overlay, skipping cache", cfg.Patterns)
+		reportOutcome(ctx, Bypass)
+		bts, err := c.runDriver(ctx, cfg)
+		if err == errSkipCache {
+			err = nil
+		}
+		return bts, err
+	}
 	key := hash.Key(cfg)
 	var resp []byte
+	var m meta
 	c.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bname)
-		resp = b.Get(key)
+		if bts := b.Get(key); bts != nil {
+			resp = append([]byte(nil), bts...)
+			m = getMeta(tx, key)
+		}
 		return nil
 	})
+	unverified := m.Unverified
 
-	if resp != nil {
-		c.lggr.Debugf("%v is already in cache", cfg.Patterns)
+	if resp != nil && !unverified {
+		lggr.Infof("%v is already in cache", cfg.Patterns)
+		if time.Since(m.LastUsed) > lastUsedPrecision {
+			c.touch(key)
+		}
+		hits.Inc()
+		reportOutcome(ctx, Hit)
 		return resp, nil
 	}
+	misses.Inc()
+
+	outcome := Miss
+	if unverified {
+		lggr.Infof("%v is unverified, re-validating", cfg.Patterns)
+		outcome = Stale
+	} else {
+		lggr.Infof("%v is not in cache", cfg.Patterns)
+	}
+	c.mu.Lock()
+	if cl, ok := c.calls[string(key)]; ok {
+		c.mu.Unlock()
+		lggr.Infof("%v is already being listed, waiting", cfg.Patterns)
+		select {
+		case <-cl.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		reportOutcome(ctx, Coalesced)
+		return cl.bts, cl.err
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[string(key)] = cl
+	c.mu.Unlock()
+	reportOutcome(ctx, outcome)
+	// The fill outlives ctx, so that a request giving up on a slow
+	// go list still leaves the result in the cache for the next one.
+	// Its go commands are still bounded by GoTimeout, and by Drain.
+	go c.complete(context.WithoutCancel(ctx), cl, cfg, key, lggr)
+	select {
+	case <-cl.done:
+		return cl.bts, cl.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// complete runs the fill of cl and hands
+// its result to the Gets waiting for it.
+func (c *service) complete(ctx context.Context, cl *call, cfg *driver.Config, key []byte, lggr *logrus.Entry) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, string(key))
+		c.mu.Unlock()
+		close(cl.done)
+	}()
+	defer crash.Recover(c.lggr, fmt.Sprintf("listing %v", cfg.Patterns), func(err error) {
+		cl.err = err
+	})
+	cl.bts, cl.err = c.fill(ctx, cfg, key, lggr)
+}
 
-	c.lggr.Debugf("%v is not in cache", cfg.Patterns)
+// touch records that the entry of key was just used.
+func (c *service) touch(key []byte) {
 	err := c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bname)
-		bts := b.Get(key)
-		if bts == nil {
-			var err error
-			c.lggr.Debugf("running first driver for %v", cfg.Patterns)
-			bts, err = runDriver(ctx, cfg)
-			if err == errSkipCache {
-				c.lggr.Debugf("skipping cache for %v", cfg.Patterns)
-				resp = bts
-				return nil
+		if tx.Bucket(bname).Get(key) == nil {
+			return nil
+		}
+		return updateMeta(tx, key, func(m *meta) {
+			m.LastUsed = time.Now()
+		})
+	})
+	if err != nil {
+		c.lggr.Errorf("could not record the use of %s: %v", key, err)
+	}
+}
+
+// fill lists cfg and stores the result under key.
+func (c *service) fill(ctx context.Context, cfg *driver.Config, key []byte, lggr *logrus.Entry) ([]byte, error) {
+	lggr.Debugf("running driver for %v", cfg.Patterns)
+	bts, err := c.refresh(ctx, cfg, key, true)
+	if err == errSkipCache {
+		lggr.Debugf("skipping cache for %v", cfg.Patterns)
+		return bts, c.delete(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bts, nil
+}
+
+func (c *service) Update(ctx context.Context, cfg *driver.Config) error {
+	lggr := logging.From(ctx, c.lggr)
+	key := hash.Key(cfg)
+	// Only the watcher of cfg updates it.
+	_, err := c.refresh(ctx, cfg, key, true)
+	if err == errSkipCache {
+		lggr.Debugf("updated cache is incorrect for %v", cfg.Patterns)
+		return c.delete(key)
+	}
+	return err
+}
+
+// refresh lists cfg and stores the result under key. If the
+// result has errors, it is returned with errSkipCache instead.
+// verify is set if cfg is listed for a client or by its watcher,
+// see commit.
+func (c *service) refresh(ctx context.Context, cfg *driver.Config, key []byte, verify bool) ([]byte, error) {
+	defer c.track(key)()
+	bts, gen, err := c.list(ctx, cfg, key)
+	if err != nil {
+		return bts, err
+	}
+	if err := c.commit(key, bts, gen, verify); err != nil {
+		return nil, fmt.Errorf("could not persist go list to boltdb: %v", err)
+	}
+	return bts, nil
+}
+
+// track counts a list of key as in flight until the returned func
+// is called. The change generation of a key is only kept while it
+// is listed, since no one compares it otherwise.
+func (c *service) track(key []byte) func() {
+	c.mu.Lock()
+	c.listing[string(key)]++
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.listing[string(key)]--; c.listing[string(key)] == 0 {
+			delete(c.listing, string(key))
+			delete(c.gens, string(key))
+		}
+	}
+}
+
+func (c *service) UpdateAll(ctx context.Context) error {
+	return c.UpdateMatching(ctx, func(*driver.Config) bool { return true })
+}
+
+func (c *service) UpdateMatching(ctx context.Context, match func(cfg *driver.Config) bool) error {
+	lggr := logging.From(ctx, c.lggr)
+	var keys [][]byte
+	unwatched := map[string]bool{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bname).ForEach(func(key, _ []byte) error {
+			keys = append(keys, append([]byte(nil), key...))
+			if !watched(getMeta(tx, key)) {
+				unwatched[string(key)] = true
 			}
-			if err != nil {
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	var num int
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		cfg, err := hash.Parse(key)
+		if err != nil {
+			lggr.Errorf("%v, removing it", err)
+			c.delete(key)
+			continue
+		}
+		if !match(cfg) {
+			continue
+		}
+		if unwatched[string(key)] {
+			// Nothing keeps the entry up to date, so
+			// listing it now would not make it trusted.
+			lggr.Debugf("%v is not watched, marking unverified", cfg.Patterns)
+			if err := c.markUnverified(key); err != nil {
+				lggr.Errorf("%v: could not mark unverified: %v", cfg.Patterns, err)
+			}
+			continue
+		}
+		lggr.Debugf("updating: %v", cfg.Patterns)
+		num++
+		_, err = c.refresh(ctx, cfg, key, false)
+		if err == errDraining {
+			return err
+		}
+		if err != nil && ctx.Err() != nil {
+			// The entry is fine, we just ran out of time.
+			return ctx.Err()
+		}
+		if err != nil {
+			lggr.Errorf("update err: %v", err)
+			lggr.Debugf("removing key: %s", key)
+			c.delete(key)
+		}
+	}
+
+	lggr.Debugf("update complete: ran driver %v times", num)
+	return nil
+}
+
+func (c *service) Changed(cfg *driver.Config, inv Invalidation) {
+	key := hash.KeyString(cfg)
+	c.mu.Lock()
+	if c.listing[key] > 0 {
+		c.gens[key]++
+	}
+	c.mu.Unlock()
+	cached, err := c.invalidated([]byte(key), inv, false)
+	if err != nil {
+		c.lggr.Errorf("%v: could not record invalidation: %v", cfg.Patterns, err)
+	}
+	if cached {
+		c.events.Publish(events.Event{Kind: events.Invalidated, Config: cfg, Reason: string(inv.Reason)})
+	}
+}
+
+// invalidated records inv as the last invalidation of key
+// and, if unverify is set, marks it unverified. It reports
+// whether key is cached.
+func (c *service) invalidated(key []byte, inv Invalidation, unverify bool) (bool, error) {
+	if inv.Time.IsZero() {
+		inv.Time = time.Now()
+	}
+	var cached bool
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bname).Get(key) == nil {
+			return nil
+		}
+		cached = true
+		return updateMeta(tx, key, func(m *meta) {
+			m.LastInvalidation = &inv
+			if unverify {
+				m.Unverified = true
+			}
+		})
+	})
+	return cached, err
+}
+
+// markUnverified marks key unverified
+// without recording an invalidation.
+func (c *service) markUnverified(key []byte) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bname).Get(key) == nil {
+			return nil
+		}
+		return updateMeta(tx, key, func(m *meta) {
+			m.Unverified = true
+		})
+	})
+}
+
+func (c *service) gen(key []byte) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gens[string(key)]
+}
+
+// list runs the driver for cfg. If the files of cfg change while
+// it runs, the result matches neither the old tree nor the new
+// one, so it is run again, up to maxRetries times. It returns the
+// change generation the result corresponds to.
+func (c *service) list(ctx context.Context, cfg *driver.Config, key []byte) ([]byte, uint64, error) {
+	for attempt := 0; ; attempt++ {
+		gen := c.gen(key)
+		bts, err := c.runDriver(ctx, cfg)
+		if err != nil && err != errSkipCache {
+			c.events.Publish(events.Event{Kind: events.ListFailed, Config: cfg, Error: err.Error()})
+			return nil, gen, err
+		}
+		if c.gen(key) == gen || attempt == maxRetries {
+			return bts, gen, err
+		}
+		logging.From(ctx, c.lggr).Debugf("%v: files changed during go list, retrying", cfg.Patterns)
+	}
+}
+
+// commit stores a response listed at generation gen. If files
+// changed since, the response is stored but marked unverified,
+// so that the next Get lists it again. A background refresh
+// only verifies the entry if it is still watched, since an
+// expired watch may have marked it unverified in the meantime;
+// verify overrides that for the client and watcher refreshes.
+func (c *service) commit(key, bts []byte, gen uint64, verify bool) error {
+	var old []byte
+	var evicted [][]byte
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		prev := tx.Bucket(bname).Get(key)
+		if c.events.Active() {
+			old = append([]byte(nil), prev...)
+		}
+		if err := putResponse(tx, key, bts, verify || watched(getMeta(tx, key))); err != nil {
+			return err
+		}
+		if prev == nil {
+			var err error
+			if evicted, err = c.evict(tx, key); err != nil {
 				return err
 			}
-			err = b.Put(key, bts)
-			if err != nil {
-				return fmt.Errorf("could not persist go list to boltdb: %v", err)
+		}
+		if c.gen(key) == gen {
+			return nil
+		}
+		c.lggr.Debugf("files changed during go list, marking %s unverified", key)
+		return updateMeta(tx, key, func(m *meta) {
+			m.Unverified = true
+		})
+	})
+	if err == nil && c.events.Active() {
+		if cfg, perr := hash.Parse(key); perr == nil {
+			c.events.Publish(refreshed(cfg, old, bts))
+		}
+		for _, key := range evicted {
+			if cfg, perr := hash.Parse(key); perr == nil {
+				c.events.Publish(events.Event{Kind: events.Evicted, Config: cfg})
 			}
-		} else {
-			c.lggr.Debugf("%v is in cache", cfg.Patterns)
 		}
-		resp = bts
+	}
+	return err
+}
 
+// evict removes entries beyond the MaxEntries limit, other than
+// keep, which must be in the cache. The entries used the longest
+// ago go first. It returns the evicted keys.
+func (c *service) evict(tx *bolt.Tx, keep []byte) ([][]byte, error) {
+	if c.maxEntries <= 0 {
+		return nil, nil
+	}
+	type candidate struct {
+		key      []byte
+		lastUsed time.Time
+	}
+	var candidates []candidate
+	tx.Bucket(bname).ForEach(func(key, _ []byte) error {
+		if !bytes.Equal(key, keep) {
+			candidates = append(candidates, candidate{
+				key:      append([]byte(nil), key...),
+				lastUsed: getMeta(tx, key).LastUsed,
+			})
+		}
 		return nil
 	})
+	// Bucket stats leave out the writes of an open
+	// transaction, so count the entries instead.
+	n := len(candidates) + 1 - c.maxEntries
+	if n <= 0 {
+		return nil, nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+	})
+	var evicted [][]byte
+	for _, cand := range candidates[:n] {
+		c.lggr.Debugf("cache is full, evicting %s", cand.key)
+		if err := deleteKey(tx, cand.key); err != nil {
+			return nil, err
+		}
+		evicted = append(evicted, cand.key)
+	}
+	return evicted, nil
+}
+
+func (c *service) delete(key []byte) error {
+	var existed bool
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		existed = tx.Bucket(bname).Get(key) != nil
+		return deleteKey(tx, key)
+	})
+	if err == nil && existed && c.events.Active() {
+		if cfg, perr := hash.Parse(key); perr == nil {
+			c.events.Publish(events.Event{Kind: events.Evicted, Config: cfg})
+		}
+	}
+	return err
+}
 
-	return resp, err
+// refreshed describes the refresh of cfg from
+// the response prev to the response cur.
+func refreshed(cfg *driver.Config, prev, cur []byte) events.Event {
+	before, _ := summarize(prev)
+	after, roots := summarize(cur)
+	e := events.Event{Kind: events.Refreshed, Config: cfg, Roots: roots}
+	for id := range after {
+		if !before[id] {
+			e.Added = append(e.Added, id)
+		}
+	}
+	for id := range before {
+		if !after[id] {
+			e.Removed = append(e.Removed, id)
+		}
+	}
+	sort.Strings(e.Added)
+	sort.Strings(e.Removed)
+	return e
 }
 
-func (c *service) Update(ctx context.Context, cfg *driver.Config) error {
+// summarize returns the package IDs and the
+// root package IDs of a cached driver response.
+func summarize(resp []byte) (map[string]bool, []string) {
+	var dr struct {
+		Roots    []string
+		Packages []struct{ ID string }
+	}
+	json.Unmarshal(resp, &dr)
+	ids := map[string]bool{}
+	for _, p := range dr.Packages {
+		ids[p.ID] = true
+	}
+	return ids, dr.Roots
+}
+
+func (c *service) SetWatch(cfg *driver.Config, deadline time.Time) error {
 	key := hash.Key(cfg)
 	return c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bname)
-		bts, err := runDriver(ctx, cfg)
-		if err == errSkipCache {
-			c.lggr.Debugf("updated cache is incorrect for %v", cfg.Patterns)
-			b.Delete(key)
+		if tx.Bucket(bname).Get(key) == nil {
 			return nil
 		}
-		if err != nil {
-			return err
+		return updateMeta(tx, key, func(m *meta) {
+			m.WatchDeadline = deadline
+		})
+	})
+}
+
+func (c *service) MarkUnverified(cfg *driver.Config, inv Invalidation) error {
+	_, err := c.invalidated(hash.Key(cfg), inv, true)
+	return err
+}
+
+func (c *service) Explain(cfg *driver.Config) (Explanation, error) {
+	key := hash.Key(cfg)
+	var e Explanation
+	err := c.db.View(func(tx *bolt.Tx) error {
+		e.Cached = tx.Bucket(bname).Get(key) != nil
+		if !e.Cached {
+			return nil
 		}
-		return b.Put(key, bts)
+		m := getMeta(tx, key)
+		e.Unverified = m.Unverified
+		e.WatchDeadline = m.WatchDeadline
+		e.LastInvalidation = m.LastInvalidation
+		return nil
 	})
+	return e, err
 }
 
-func (c *service) UpdateAll(ctx context.Context) error {
-	return c.db.Update(func(tx *bolt.Tx) error {
+func (c *service) Watches() ([]Watch, error) {
+	var watches []Watch
+	err := c.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bname)
-		cur := b.Cursor()
-		var num int
-		for key, _ := cur.First(); key != nil; key, _ = cur.Next() {
-			cfg := hash.Parse(key)
-			c.lggr.Debugf("updating: %v", cfg.Patterns)
-			bts, err := runDriver(ctx, cfg)
+		return tx.Bucket(mname).ForEach(func(key, val []byte) error {
+			if b.Get(key) == nil {
+				return nil
+			}
+			var m meta
+			if err := json.Unmarshal(val, &m); err != nil {
+				c.lggr.Errorf("bad meta for %s: %v", key, err)
+				return nil
+			}
+			if m.WatchDeadline.IsZero() {
+				return nil
+			}
+			cfg, err := hash.Parse(key)
 			if err != nil {
-				c.lggr.Errorf("driver err: %v", err)
-				c.lggr.Debugf("removing key: %s", key)
-				b.Delete(key)
-				continue
+				c.lggr.Error(err)
+				return nil
 			}
-			num++
-			err = b.Put(key, bts)
+			watches = append(watches, Watch{Config: cfg, Deadline: m.WatchDeadline})
+			return nil
+		})
+	})
+	return watches, err
+}
+
+func (c *service) Delete(cfg *driver.Config) error {
+	return c.delete(hash.Key(cfg))
+}
+
+func (c *service) Entries() ([]Entry, error) {
+	var entries []Entry
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bname).ForEach(func(key, val []byte) error {
+			cfg, err := hash.Parse(key)
 			if err != nil {
-				c.lggr.Errorf("udpate err: %v", err)
-				c.lggr.Debugf("removing key: %s", key)
-				b.Delete(key)
-				continue
+				c.lggr.Error(err)
+				return nil
+			}
+			entries = append(entries, Entry{Config: cfg, Dirs: packageDirs(val)})
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// packageDirs returns the directories of the
+// packages of a cached driver response.
+func packageDirs(resp []byte) []string {
+	var dr struct {
+		Packages []struct {
+			GoFiles    []string
+			OtherFiles []string
+		}
+	}
+	json.Unmarshal(resp, &dr)
+	seen := map[string]bool{}
+	var dirs []string
+	for _, p := range dr.Packages {
+		for _, file := range append(p.GoFiles, p.OtherFiles...) {
+			dir := filepath.Dir(file)
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
 			}
 		}
+	}
+	return dirs
+}
 
-		c.lggr.Debugf("update all complete: ran driver %v times", num)
+func (c *service) Stats() (Stats, error) {
+	st := Stats{Path: c.db.Path()}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		st.Size = tx.Size()
+		st.Entries = tx.Bucket(bname).Stats().KeyN
 		return nil
 	})
+	c.mu.Lock()
+	for r := range c.runs {
+		st.Runs = append(st.Runs, *r)
+	}
+	c.mu.Unlock()
+	sort.Slice(st.Runs, func(i, j int) bool {
+		return st.Runs[i].Started.Before(st.Runs[j].Started)
+	})
+	return st, err
+}
+
+// killWait is how long Drain waits for cancelled
+// runs to kill their go commands.
+const killWait = time.Second
+
+func (c *service) Drain(ctx context.Context) error {
+	c.mu.Lock()
+	c.draining = true
+	c.mu.Unlock()
+	if err := c.waitRuns(ctx); err == nil {
+		return nil
+	}
+	c.mu.Lock()
+	for r := range c.runs {
+		r.cancel()
+	}
+	c.mu.Unlock()
+	killCtx, cancel := context.WithTimeout(context.Background(), killWait)
+	defer cancel()
+	c.waitRuns(killCtx)
+	return ctx.Err()
+}
+
+// waitRuns waits until no runs are in flight or ctx is done.
+func (c *service) waitRuns(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		c.mu.Lock()
+		n := len(c.runs)
+		c.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 func (c *service) Close() error {
@@ -149,6 +899,92 @@ func (c *service) Close() error {
 
 var errSkipCache = fmt.Errorf("internal errors, skip cache")
 
+var errDraining = fmt.Errorf("server is shutting down")
+
+// getMeta returns the meta of key, or its zero value if there is none.
+func getMeta(tx *bolt.Tx, key []byte) meta {
+	var m meta
+	if bts := tx.Bucket(mname).Get(key); bts != nil {
+		json.Unmarshal(bts, &m)
+	}
+	return m
+}
+
+func updateMeta(tx *bolt.Tx, key []byte, fn func(m *meta)) error {
+	m := getMeta(tx, key)
+	fn(&m)
+	bts, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(mname).Put(key, bts)
+}
+
+// putResponse stores a freshly listed response, which
+// counts as a use and, if verified is set, verifies the entry.
+func putResponse(tx *bolt.Tx, key, bts []byte, verified bool) error {
+	if err := tx.Bucket(bname).Put(key, bts); err != nil {
+		return err
+	}
+	return updateMeta(tx, key, func(m *meta) {
+		if verified {
+			m.Unverified = false
+		}
+		m.LastUsed = time.Now()
+	})
+}
+
+// watched reports whether the persisted watch
+// registration of an entry has not expired.
+func watched(m meta) bool {
+	return m.WatchDeadline.After(time.Now())
+}
+
+// deleteKey removes a cached response and its meta.
+func deleteKey(tx *bolt.Tx, key []byte) error {
+	if err := tx.Bucket(bname).Delete(key); err != nil {
+		return err
+	}
+	return tx.Bucket(mname).Delete(key)
+}
+
+// runDriver runs the driver for cfg,
+// tracking the run while it is in flight.
+func (c *service) runDriver(ctx context.Context, cfg *driver.Config) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r := &Run{Patterns: cfg.Patterns, Dir: cfg.Dir, Started: time.Now(), cancel: cancel}
+	c.mu.Lock()
+	if c.draining {
+		c.mu.Unlock()
+		return nil, errDraining
+	}
+	c.runs[r] = true
+	c.mu.Unlock()
+	if c.sched != nil {
+		ctx = sched.WithScheduler(ctx, c.sched)
+	}
+	if c.goTimeout > 0 {
+		ctx = driver.WithInvocationTimeout(ctx, c.goTimeout)
+	}
+	lggr := logging.From(ctx, c.lggr)
+	ctx = driver.WithTrace(ctx, func(inv driver.Invocation) {
+		entry := lggr.WithFields(logrus.Fields{"dir": inv.Dir, "duration": inv.Duration.String()})
+		if inv.Err != nil {
+			entry.Warnf("go %v: %v", strings.Join(inv.Args, " "), inv.Err)
+			return
+		}
+		entry.Infof("go %v", strings.Join(inv.Args, " "))
+	})
+	defer func() {
+		c.mu.Lock()
+		delete(c.runs, r)
+		c.mu.Unlock()
+		listDuration.Observe(time.Since(r.Started).Seconds())
+	}()
+	return runDriver(ctx, cfg)
+}
+
 func runDriver(ctx context.Context, cfg *driver.Config) ([]byte, error) {
 	dresp, err := driver.GoListDriver(ctx, cfg)
 	if err != nil {
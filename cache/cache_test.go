@@ -0,0 +1,366 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"marwan.io/golist/driver"
+	"marwan.io/golist/events"
+	"marwan.io/golist/hash"
+)
+
+func newTestService(t *testing.T, opts Options) *service {
+	t.Helper()
+	lggr := logrus.New()
+	lggr.SetOutput(ioutil.Discard)
+	dc, err := New(filepath.Join(t.TempDir(), "golist.db"), lggr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dc.Close() })
+	return dc.(*service)
+}
+
+// testModule writes a module with one package
+// and returns the config listing it.
+func testModule(t *testing.T) *driver.Config {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "go.mod"), "module example.com/a\n")
+	writeFile(t, filepath.Join(dir, "a.go"), "package a\n")
+	return &driver.Config{
+		Mode:     driver.LoadFiles,
+		Dir:      dir,
+		Patterns: []string{"."},
+		Env:      append(os.Environ(), "GOFLAGS=", "GO111MODULE=on"),
+	}
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// slowGo puts a go command that waits for d
+// before running the real one first in PATH.
+func slowGo(t *testing.T, d time.Duration) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	dir := t.TempDir()
+	script := fmt.Sprintf("#!/bin/sh\nsleep %v\nexec %q \"$@\"\n", d.Seconds(), gobin)
+	if err := ioutil.WriteFile(filepath.Join(dir, "go"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+}
+
+// countGo returns a context in which
+// the go commands run are counted into n.
+func countGo(ctx context.Context, n *int32) context.Context {
+	return driver.WithTrace(ctx, func(driver.Invocation) {
+		atomic.AddInt32(n, 1)
+	})
+}
+
+func TestGetCoalescesMisses(t *testing.T) {
+	slowGo(t, 200*time.Millisecond)
+	c := newTestService(t, Options{})
+
+	// A single Get tells how many go commands listing a config takes.
+	var want int32
+	if _, err := c.Get(countGo(context.Background(), &want), testModule(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testModule(t)
+	var got int32
+	ctx := countGo(context.Background(), &got)
+	resps := make([][]byte, 4)
+	errs := make([]error, len(resps))
+	var wg sync.WaitGroup
+	for i := range resps {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resps[i], errs[i] = c.Get(ctx, cfg)
+		}(i)
+	}
+	wg.Wait()
+	for i := range resps {
+		if errs[i] != nil {
+			t.Fatalf("Get %d: %v", i, errs[i])
+		}
+		if !bytes.Equal(resps[i], resps[0]) {
+			t.Errorf("Get %d returned a different response", i)
+		}
+	}
+	if got != want {
+		t.Fatalf("concurrent Gets ran %d go commands, want %d", got, want)
+	}
+}
+
+func TestGetTimeoutStillCaches(t *testing.T) {
+	slowGo(t, 200*time.Millisecond)
+	c := newTestService(t, Options{})
+	cfg := testModule(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(ctx, cfg); err != context.DeadlineExceeded {
+		t.Fatalf("Get() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// The go list run of the request that gave up fills the cache.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		e, err := c.Explain(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Cached {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("entry not cached after the request timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var n int32
+	if _, err := c.Get(countGo(context.Background(), &n), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("Get ran %d go commands, want a cache hit", n)
+	}
+}
+
+func TestCommitVerifies(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		deadline time.Duration
+		verify   bool
+		want     bool
+	}{
+		{name: "watched", deadline: time.Hour, want: false},
+		{name: "watch expired", deadline: -time.Minute, want: true},
+		{name: "not watched", want: true},
+		{name: "client request", deadline: -time.Minute, verify: true, want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestService(t, Options{})
+			cfg := &driver.Config{Dir: "/src/a", Patterns: []string{"./..."}}
+			key := hash.Key(cfg)
+			if err := c.commit(key, []byte("old"), 0, true); err != nil {
+				t.Fatal(err)
+			}
+			if tc.deadline != 0 {
+				if err := c.SetWatch(cfg, time.Now().Add(tc.deadline)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.MarkUnverified(cfg, Invalidation{Reason: WatchExpired}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.commit(key, []byte("new"), 0, tc.verify); err != nil {
+				t.Fatal(err)
+			}
+			e, err := c.Explain(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Unverified != tc.want {
+				t.Fatalf("Unverified = %v, want %v", e.Unverified, tc.want)
+			}
+		})
+	}
+}
+
+func TestUpdateAllSkipsUnwatched(t *testing.T) {
+	c := newTestService(t, Options{})
+	watchedCfg, unwatchedCfg := testModule(t), testModule(t)
+	var perList int32
+	if _, err := c.Get(countGo(context.Background(), &perList), watchedCfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(context.Background(), unwatchedCfg); err != nil {
+		t.Fatal(err)
+	}
+	c.SetWatch(watchedCfg, time.Now().Add(time.Hour))
+	// The watch of the other entry expired while the server was down.
+	c.SetWatch(unwatchedCfg, time.Now().Add(-time.Minute))
+
+	var n int32
+	if err := c.UpdateAll(countGo(context.Background(), &n)); err != nil {
+		t.Fatal(err)
+	}
+	if n != perList {
+		t.Errorf("UpdateAll ran %d go commands, want %d for the watched entry only", n, perList)
+	}
+	for _, tc := range []struct {
+		cfg  *driver.Config
+		want bool
+	}{
+		{cfg: watchedCfg, want: false},
+		{cfg: unwatchedCfg, want: true},
+	} {
+		e, err := c.Explain(tc.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Unverified != tc.want {
+			t.Errorf("%v: Unverified = %v, want %v", tc.cfg.Dir, e.Unverified, tc.want)
+		}
+	}
+}
+
+func TestChangedPublishesInvalidated(t *testing.T) {
+	bus := events.NewBus()
+	c := newTestService(t, Options{Events: bus})
+	cached := &driver.Config{Dir: "/src/a", Patterns: []string{"./..."}}
+	if err := c.commit(hash.Key(cached), []byte("[]"), 0, true); err != nil {
+		t.Fatal(err)
+	}
+	ch, cancel := bus.Subscribe()
+	defer cancel()
+	c.Changed(&driver.Config{Dir: "/src/b", Patterns: []string{"./..."}}, Invalidation{Reason: FileChanged})
+	c.Changed(cached, Invalidation{Reason: FileChanged, Path: "/src/a/a.go"})
+	select {
+	case e := <-ch:
+		if e.Kind != events.Invalidated || e.Config.Dir != cached.Dir || e.Reason != string(FileChanged) {
+			t.Fatalf("got %+v, want an invalidated event of %v", e, cached.Dir)
+		}
+	default:
+		t.Fatal("no event published")
+	}
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestGetRetriesWhenFilesChange(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// changes is how many go list runs see the files change.
+		changes        int
+		wantRuns       int
+		wantUnverified bool
+	}{
+		{name: "no change", changes: 0, wantRuns: 1},
+		{name: "changed once", changes: 1, wantRuns: 2},
+		{name: "keeps changing", changes: maxRetries + 1, wantRuns: maxRetries + 1, wantUnverified: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestService(t, Options{})
+			cfg := testModule(t)
+			var runs int
+			ctx := driver.WithTrace(context.Background(), func(inv driver.Invocation) {
+				if len(inv.Args) == 0 || inv.Args[0] != "list" {
+					return
+				}
+				runs++
+				if runs <= tc.changes {
+					c.Changed(cfg, Invalidation{Reason: FileChanged})
+				}
+			})
+			if _, err := c.Get(ctx, cfg); err != nil {
+				t.Fatal(err)
+			}
+			if runs != tc.wantRuns {
+				t.Errorf("ran go list %d times, want %d", runs, tc.wantRuns)
+			}
+			e, err := c.Explain(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Unverified != tc.wantUnverified {
+				t.Errorf("Unverified = %v, want %v", e.Unverified, tc.wantUnverified)
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if len(c.gens) != 0 || len(c.listing) != 0 {
+				t.Errorf("generations kept after listing: %v, %v", c.gens, c.listing)
+			}
+		})
+	}
+}
+
+func TestEvict(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		maxEntries int
+		// want are the entries left, by name.
+		want []string
+	}{
+		{name: "no limit", maxEntries: 0, want: []string{"a", "b", "c"}},
+		{name: "least recently used first", maxEntries: 2, want: []string{"b", "c"}},
+		{name: "keeps the new entry", maxEntries: 1, want: []string{"c"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestService(t, Options{MaxEntries: tc.maxEntries})
+			cfgs := map[string]*driver.Config{}
+			// a was used before b, and c is added last.
+			for i, name := range []string{"a", "b", "c"} {
+				cfg := &driver.Config{Dir: "/src/" + name, Patterns: []string{"./..."}}
+				cfgs[name] = cfg
+				key := hash.Key(cfg)
+				if err := c.commit(key, []byte("[]"), 0, true); err != nil {
+					t.Fatal(err)
+				}
+				lastUsed := time.Now().Add(time.Duration(i-3) * time.Hour)
+				err := c.db.Update(func(tx *bolt.Tx) error {
+					return updateMeta(tx, key, func(m *meta) { m.LastUsed = lastUsed })
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []string
+			for _, name := range []string{"a", "b", "c"} {
+				e, err := c.Explain(cfgs[name])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.Cached {
+					got = append(got, name)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("cached %v, want %v", got, tc.want)
+			}
+			stats, err := c.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Entries != len(tc.want) {
+				t.Fatalf("Stats().Entries = %d, want %d", stats.Entries, len(tc.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package cmddriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"time"
+
+	"marwan.io/golist/driver"
+	"marwan.io/golist/server"
+)
+
+// Environment variables that tune the client. They are read from the
+// environment since go/packages runs the driver without extra flags.
+const (
+	// fallbackEnv set to "off" disables running go list in-process
+	// when the server is unavailable, which helps debugging the server.
+	fallbackEnv = "GOLIST_FALLBACK"
+	// budgetEnv is the longest the client waits for the server
+	// to start and take its request before falling back, as a
+	// time.Duration. Once the server has the request, the client
+	// waits for its answer, since falling back then would run
+	// go list twice; the server's go timeout bounds that wait.
+	budgetEnv = "GOLIST_LATENCY_BUDGET"
+)
+
+const defaultBudget = 10 * time.Second
+
+func fallbackEnabled() bool {
+	return os.Getenv(fallbackEnv) != "off"
+}
+
+func latencyBudget() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(budgetEnv)); err == nil && d > 0 {
+		return d
+	}
+	return defaultBudget
+}
+
+// query asks the server for the driver response of cfg,
+// starting the server if it is not running yet.
+func query(cfg *driver.Config) ([]byte, error) {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(server.NewRequest(cfg)); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), latencyBudget())
+	defer cancel()
+
+	client := getClient()
+	bts, err := send(ctx, client, body.Bytes())
+	if _, ok := err.(*server.Error); err != nil && !ok && ctx.Err() == nil {
+		if err := ensureServer(ctx); err != nil {
+			return nil, err
+		}
+		bts, err = send(ctx, client, body.Bytes())
+	}
+	if e, ok := err.(*server.Error); ok && e.Code == server.CodeVersionMismatch {
+		// The server was started from an older golist.
+		if err := restartServer(ctx, client); err != nil {
+			return nil, err
+		}
+		bts, err = send(ctx, client, body.Bytes())
+	}
+	return bts, err
+}
+
+// send posts body to the server and returns the response body,
+// or a *server.Error if the server answered with an error.
+// ctx only bounds the request until it is written to the server.
+func send(ctx context.Context, client *http.Client, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, "http://unix/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	server.SetVersionHeaders(req)
+	reqCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	written := make(chan struct{})
+	var once sync.Once
+	reqCtx = httptrace.WithClientTrace(reqCtx, &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				once.Do(func() { close(written) })
+			}
+		},
+	})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-written:
+		case <-reqCtx.Done():
+		}
+	}()
+	resp, err := client.Do(req.WithContext(reqCtx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, server.ReadError(resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// unavailable reports whether err means the server could not
+// answer, as opposed to go list itself failing, in which
+// case running it in-process would not help.
+func unavailable(err error) bool {
+	e, ok := err.(*server.Error)
+	if !ok {
+		return true
+	}
+	return e.Code == server.CodeTimeout || e.Code == server.CodeOverloaded || e.Code == server.CodeInternal
+}
+
+// listDirect runs the driver in-process, bypassing the server.
+func listDirect(cfg *driver.Config) ([]byte, error) {
+	resp, err := driver.GoListDriver(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
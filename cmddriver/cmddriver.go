@@ -3,15 +3,15 @@ package cmddriver
 import (
 	"bytes"
 	"context"
-	"encoding/gob"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"time"
 
 	"marwan.io/golist/driver"
@@ -19,10 +19,18 @@ import (
 )
 
 type config struct {
-	server   bool
-	verbose  bool
-	exit     bool
-	patterns []string
+	server       bool
+	verbose      bool
+	exit         bool
+	poll         bool
+	pollInterval time.Duration
+	watchExpiry  time.Duration
+	ignore       []string
+	idleTimeout  time.Duration
+	maxProcs     int
+	maxQueue     int
+	goTimeout    time.Duration
+	patterns     []string
 }
 
 type driverRequest struct {
@@ -38,6 +46,16 @@ func getFlags() *config {
 	sflag := fs.Bool("s", false, "run the golist server")
 	verbose := fs.Bool("v", false, "verbose golist server")
 	exit := fs.Bool("exit", false, "exit the server")
+	// The server flags override the configuration file,
+	// so they have no defaults of their own.
+	poll := fs.Bool("poll", false, "poll files instead of using native file system notifications")
+	pollInterval := fs.Duration("poll-interval", 0, "how often polled files are checked (default 2s)")
+	watchExpiry := fs.Duration("watch-expiry", 0, "how long entries are watched after their last request (default 1h)")
+	ignore := fs.String("ignore", "", "comma separated gitignore style patterns of files the watcher ignores")
+	idleTimeout := fs.Duration("idle-timeout", 0, "exit the server after this long without requests (default never)")
+	maxProcs := fs.Int("max-procs", 0, "the most go commands the server runs at once (default the number of CPUs)")
+	goTimeout := fs.Duration("go-timeout", 0, "kill go commands of the server that run longer than this (default 5m)")
+	maxQueue := fs.Int("max-queue", 0, "the most requests waiting for a go command before the server is busy (default 32)")
 
 	err := fs.Parse(os.Args[1:])
 	if err != nil {
@@ -45,25 +63,33 @@ func getFlags() *config {
 	}
 
 	return &config{
-		server:   *sflag,
-		verbose:  *verbose,
-		exit:     *exit,
-		patterns: fs.Args(),
+		server:       *sflag,
+		verbose:      *verbose,
+		exit:         *exit,
+		poll:         *poll,
+		pollInterval: *pollInterval,
+		watchExpiry:  *watchExpiry,
+		ignore:       server.SplitList(*ignore),
+		idleTimeout:  *idleTimeout,
+		maxProcs:     *maxProcs,
+		maxQueue:     *maxQueue,
+		goTimeout:    *goTimeout,
+		patterns:     fs.Args(),
 	}
 }
 
-func getCfg(c *config) *driver.Config {
+func getCfg(c *config, stdin io.Reader) *driver.Config {
 	var cfg driver.Config
 	cfg.Patterns = c.patterns
 
 	var dr driverRequest
-	must(json.NewDecoder(os.Stdin).Decode(&dr))
+	must(json.NewDecoder(stdin).Decode(&dr))
 	cfg.Dir = getDir()
 	cfg.Mode = dr.Mode
 	cfg.Env = dr.Env
 	cfg.BuildFlags = dr.BuildFlags
 	cfg.Tests = dr.Tests
-	// TODO: overlay once go list takes overlay.
+	cfg.Overlay = dr.Overlay
 
 	return &cfg
 }
@@ -76,66 +102,121 @@ func getDir() string {
 	return dir
 }
 
-func getBody(c *config) (io.Reader, error) {
-	var bts bytes.Buffer
-	err := gob.NewEncoder(&bts).Encode(getCfg(c))
-	return &bts, err
+// requestOnStdin reads stdin and reports whether it holds a driver
+// request, returning what it read. go/packages always pipes one in,
+// while stdin is left alone when it is a terminal or /dev/null.
+func requestOnStdin() ([]byte, bool) {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice != 0 {
+		return nil, false
+	}
+	bts, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, false
+	}
+	var dr driverRequest
+	return bts, json.Unmarshal(bts, &dr) == nil
 }
 
 // Main starts the daemon or client
 func Main() {
+	var stdin io.Reader = os.Stdin
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			// A package may be named like a command.
+			bts, isRequest := requestOnStdin()
+			if !isRequest {
+				cmd(os.Args[2:])
+				return
+			}
+			stdin = bytes.NewReader(bts)
+		}
+	}
 	c := getFlags()
 	if c.server {
-		must(server.RunServer(c.verbose))
+		fatal(server.RunServer(server.Options{
+			Verbose:      c.verbose,
+			Poll:         c.poll,
+			PollInterval: c.pollInterval,
+			WatchExpiry:  c.watchExpiry,
+			Ignore:       c.ignore,
+			IdleTimeout:  c.idleTimeout,
+			MaxProcs:     c.maxProcs,
+			MaxQueue:     c.maxQueue,
+			GoTimeout:    c.goTimeout,
+		}))
 		return
 	}
 
-	client := getClient()
-	var b io.Reader
-	var err error
-	if !c.exit {
-		b, err = getBody(c)
-	}
-	must(err)
-	url := "http://unix/"
 	if c.exit {
-		url += "exit"
+		exitServer()
+		return
 	}
 
-	req, _ := http.NewRequest(http.MethodPost, url, b)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
-	defer cancel()
-	req = req.WithContext(ctx)
-	resp, err := client.Do(req)
+	cfg := getCfg(c, stdin)
+	bts, err := query(cfg)
+	if err != nil && unavailable(err) && fallbackEnabled() {
+		fmt.Fprintf(os.Stderr, "golist: server unavailable (%v), running go list directly\n", err)
+		bts, err = listDirect(cfg)
+	}
 	if err != nil {
-		if c.exit {
-			// don't close the server if it's already closed
-			// TODO: check for no conn err
-			return
-		}
-		tryServer()
-		time.Sleep(time.Second * 2)
-		resp, err = client.Do(req)
+		fail(err)
 	}
-	must(err)
-	defer resp.Body.Close()
-	io.Copy(os.Stdout, resp.Body)
+	os.Stdout.Write(bts)
 }
 
-func tryServer() error {
-	return exec.Command("golist", "-s").Start()
+// exitServer stops the running server, if any, and
+// reports whether there was one.
+func exitServer() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	pid, err := stopServer(ctx, getClient(), false)
+	if err != nil {
+		fmt.Println("no golist server running")
+		return
+	}
+	if pid != "" {
+		fmt.Printf("stopped golist server (pid %v)\n", pid)
+		return
+	}
+	fmt.Println("stopped golist server")
 }
 
 func getClient() *http.Client {
 	socket := server.GetSocketPath()
 	return &http.Client{
-		Transport: &http.Transport{DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-			return net.DialTimeout("unix", socket, time.Second*30)
+		Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			// Don't talk to a socket another user could have planted.
+			if err := server.PrepareSocketDir(); err != nil {
+				return nil, err
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
 		}},
-		Timeout: time.Second * 30,
 	}
 }
 
+// fatal reports a server error and exits.
+func fatal(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "golist: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// fail reports err the way go/packages expects
+// from a driver: on stderr, with a non-zero exit.
+func fail(err error) {
+	if e, ok := err.(*server.Error); ok && e.RequestID != "" {
+		fmt.Fprintf(os.Stderr, "golist: %v (%v, request %v)\n", e.Message, e.Code, e.RequestID)
+	} else if ok {
+		fmt.Fprintf(os.Stderr, "golist: %v (%v)\n", e.Message, e.Code)
+	} else {
+		fmt.Fprintf(os.Stderr, "golist: %v\n", err)
+	}
+	os.Exit(1)
+}
+
 func must(err error) {
 	if err != nil {
 		panic(err)
@@ -0,0 +1,49 @@
+package cmddriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRequestOnStdin(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		stdin string
+		// devNull reads stdin from os.DevNull instead.
+		devNull bool
+		want    bool
+	}{
+		{name: "driver request", stdin: `{"mode": 1, "env": [], "tests": false}`, want: true},
+		{name: "empty", stdin: "", want: false},
+		{name: "not json", stdin: "yes\n", want: false},
+		{name: "dev null", devNull: true, want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := os.DevNull
+			if !tc.devNull {
+				name = filepath.Join(t.TempDir(), "stdin")
+				if err := ioutil.WriteFile(name, []byte(tc.stdin), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			stdin := os.Stdin
+			os.Stdin = f
+			defer func() { os.Stdin = stdin }()
+
+			bts, got := requestOnStdin()
+			if got != tc.want {
+				t.Fatalf("requestOnStdin() = %v, want %v", got, tc.want)
+			}
+			if got && string(bts) != tc.stdin {
+				t.Fatalf("requestOnStdin() read %q, want %q", bts, tc.stdin)
+			}
+		})
+	}
+}
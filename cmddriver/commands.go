@@ -0,0 +1,194 @@
+package cmddriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"marwan.io/golist/server"
+)
+
+// commands are the golist subcommands. go/packages runs the driver
+// with package patterns as arguments and the driver request on stdin,
+// so a first argument naming a command is only taken as the command
+// when stdin holds no driver request.
+var commands = map[string]func(args []string){
+	"status":     statusCommand,
+	"invalidate": invalidateCommand,
+	"config":     configCommand,
+	"logs":       logsCommand,
+}
+
+// call sends a request for path to the running server, with body
+// encoded as JSON unless it is nil, and decodes the JSON response
+// into v. It never starts a server.
+func call(method, path string, body, v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var r io.Reader
+	if body != nil {
+		bts, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(bts)
+	}
+	req, err := http.NewRequest(method, "http://unix"+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	server.SetVersionHeaders(req)
+	resp, err := getClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return server.ReadError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func statusCommand(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	fs.Parse(args)
+
+	var st server.Status
+	if err := call(http.MethodGet, "/status", nil, &st); err != nil {
+		if _, ok := err.(*server.Error); ok {
+			fail(err)
+		}
+		fmt.Println("no golist server running")
+		os.Exit(1)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(st)
+		return
+	}
+	updating := "done"
+	if st.UpdatingAll {
+		updating = "running"
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "pid:\t%v\n", st.PID)
+	fmt.Fprintf(tw, "version:\t%v (protocol %v, build %v)\n", st.Version.Version, st.Version.Protocol, st.Version.BuildID)
+	fmt.Fprintf(tw, "uptime:\t%v\n", st.Uptime)
+	fmt.Fprintf(tw, "socket:\t%v\n", st.Socket)
+	fmt.Fprintf(tw, "db:\t%v (%v bytes, %v entries)\n", st.DBPath, st.DBSize, st.Entries)
+	fmt.Fprintf(tw, "startup update:\t%v\n", updating)
+	fmt.Fprintf(tw, "crashes:\t%v\n", st.Crashes)
+	fmt.Fprintf(tw, "go processes:\t%v running (max %v), %v interactive and %v background queued\n",
+		st.Scheduler.Running, st.Scheduler.MaxProcs, st.Scheduler.Queued["interactive"], st.Scheduler.Queued["background"])
+	tw.Flush()
+
+	fmt.Printf("\nwatchers (%v):\n", len(st.Watchers))
+	for _, w := range st.Watchers {
+		how := "native"
+		if w.Polling {
+			how = "polling"
+		}
+		fmt.Fprintf(tw, "  %v\t%v\texpires in %v\t%v\n",
+			strings.Join(w.Patterns, " "), w.Dir, time.Until(w.Expires).Round(time.Second), how)
+	}
+	tw.Flush()
+
+	fmt.Printf("\ngo list runs (%v):\n", len(st.Runs))
+	for _, r := range st.Runs {
+		fmt.Fprintf(tw, "  %v\t%v\t%v\n", strings.Join(r.Patterns, " "), r.Dir, r.Elapsed)
+	}
+	tw.Flush()
+}
+
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func invalidateCommand(args []string) {
+	fs := flag.NewFlagSet("invalidate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: golist invalidate [-drop] [-all] [-module root]... [-pattern pattern]... [paths...]")
+		fs.PrintDefaults()
+	}
+	drop := fs.Bool("drop", false, "drop the matching entries instead of refreshing them in the background")
+	all := fs.Bool("all", false, "invalidate every entry")
+	var modules, patterns listFlag
+	fs.Var(&modules, "module", "invalidate every entry under this module root (repeatable)")
+	fs.Var(&patterns, "pattern", "invalidate the entries listing this package pattern (repeatable)")
+	fs.Parse(args)
+
+	req := server.InvalidateRequest{Patterns: patterns, All: *all, Drop: *drop}
+	for _, path := range fs.Args() {
+		req.Paths = append(req.Paths, absPath(path))
+	}
+	for _, root := range modules {
+		req.Modules = append(req.Modules, absPath(root))
+	}
+	if len(req.Paths) == 0 && len(req.Modules) == 0 && len(req.Patterns) == 0 && !req.All {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var resp server.InvalidateResponse
+	if err := call(http.MethodPost, "/invalidate", &req, &resp); err != nil {
+		if _, ok := err.(*server.Error); ok {
+			fail(err)
+		}
+		// Nothing is cached in memory and the next
+		// server revalidates every entry at startup.
+		fmt.Fprintln(os.Stderr, "no golist server running")
+		return
+	}
+	if resp.Dropped {
+		fmt.Printf("dropped %v entries\n", resp.Matched)
+		return
+	}
+	fmt.Printf("refreshing %v entries\n", resp.Matched)
+}
+
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		fail(err)
+	}
+	return abs
+}
+
+// configCommand prints the settings a server started now would
+// use: the defaults, overridden by the configuration file and env.
+func configCommand(args []string) {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	path := fs.Bool("path", false, "print the path of the configuration file instead")
+	fs.Parse(args)
+	if *path {
+		fmt.Println(server.ConfigPath())
+		return
+	}
+	cfg, err := server.LoadConfig()
+	if err != nil {
+		fail(err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	must(enc.Encode(cfg))
+}
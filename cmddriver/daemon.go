@@ -0,0 +1,159 @@
+package cmddriver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"marwan.io/golist/server"
+)
+
+// startTimeout is how long a start marker is honored. After that,
+// the client that wrote it is assumed to have died mid-start.
+const startTimeout = 10 * time.Second
+
+// ensureServer starts the server unless another client is already
+// starting it, then waits until the server accepts connections.
+func ensureServer(ctx context.Context) error {
+	socket := server.GetSocketPath()
+	if err := server.PrepareSocketDir(); err != nil {
+		return err
+	}
+	marker := socket + ".starting"
+	var exited <-chan error
+	if claimStart(marker) {
+		defer os.Remove(marker)
+		var err error
+		if exited, err = startServer(); err != nil {
+			return err
+		}
+	}
+	return waitReady(ctx, socket, exited)
+}
+
+// claimStart reports whether this client won the right to start
+// the server. Clients racing each other create the same marker
+// file exclusively, so only one of them spawns a server.
+func claimStart(marker string) bool {
+	f, err := os.OpenFile(marker, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err == nil {
+		f.Close()
+		return true
+	}
+	if fi, err := os.Stat(marker); err == nil && time.Since(fi.ModTime()) > startTimeout {
+		// The client that made it gave up. If its marker cannot be
+		// removed, no one can claim the start: just wait instead.
+		if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+			return false
+		}
+		return claimStart(marker)
+	}
+	return false
+}
+
+// startServer runs this very executable as the server, rather than
+// whatever golist is first in PATH, detached from the client so
+// that it outlives it and does not receive its signals. The server
+// inherits the client's env, so GOLIST_* settings such as
+// GOLIST_IDLE_TIMEOUT apply to it. The returned channel
+// receives the result of the server's process once it exits.
+func startServer() (<-chan error, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, "-s")
+	cmd.SysProcAttr = detached()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	return exited, nil
+}
+
+// waitReady dials the socket with an exponential backoff until the
+// server accepts connections. It gives up early once exited, which
+// is nil unless this client started the server, receives a value.
+func waitReady(ctx context.Context, socket string, exited <-chan error) error {
+	backoff := 10 * time.Millisecond
+	for {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "unix", socket)
+		if err == nil {
+			return conn.Close()
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-exited:
+			// Another server may have won the lock and be serving.
+			if conn, derr := d.DialContext(ctx, "unix", socket); derr == nil {
+				return conn.Close()
+			}
+			if err == nil {
+				return fmt.Errorf("server exited before accepting connections")
+			}
+			return fmt.Errorf("server exited before accepting connections: %v", err)
+		}
+		if backoff *= 2; backoff > 250*time.Millisecond {
+			backoff = 250 * time.Millisecond
+		}
+	}
+}
+
+// stopServer asks the server to exit and waits until it is gone,
+// returning its pid if it reported one. With outdated set, the
+// server only exits if it was built from a different binary, so
+// that clients racing to restart an old server don't stop the
+// new one.
+func stopServer(ctx context.Context, client *http.Client, outdated bool) (string, error) {
+	url := "http://unix/exit"
+	if outdated {
+		url += "?outdated=1"
+	}
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return "", err
+	}
+	server.SetVersionHeaders(req)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return "", nil
+	}
+	pid, _ := ioutil.ReadAll(resp.Body)
+	waitGone(ctx, server.GetSocketPath())
+	return strings.TrimSpace(string(pid)), nil
+}
+
+// restartServer replaces an outdated server with one
+// started from this executable.
+func restartServer(ctx context.Context, client *http.Client) error {
+	stopServer(ctx, client, true)
+	return ensureServer(ctx)
+}
+
+// waitGone waits for a stopping server to remove its socket.
+func waitGone(ctx context.Context, socket string) {
+	for {
+		if _, err := os.Stat(socket); os.IsNotExist(err) {
+			return
+		}
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
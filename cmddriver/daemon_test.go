@@ -0,0 +1,65 @@
+package cmddriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClaimStart(t *testing.T) {
+	stale := time.Now().Add(-2 * startTimeout)
+	for _, tc := range []struct {
+		name string
+		// setup creates whatever is at marker beforehand.
+		setup func(t *testing.T, marker string)
+		want  bool
+	}{
+		{name: "no marker", setup: func(*testing.T, string) {}, want: true},
+		{
+			name: "fresh marker",
+			setup: func(t *testing.T, marker string) {
+				writeMarker(t, marker, time.Now())
+			},
+			want: false,
+		},
+		{
+			name: "stale marker",
+			setup: func(t *testing.T, marker string) {
+				writeMarker(t, marker, stale)
+			},
+			want: true,
+		},
+		{
+			name: "stale marker that cannot be removed",
+			setup: func(t *testing.T, marker string) {
+				if err := os.MkdirAll(filepath.Join(marker, "dir"), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(marker, stale, stale); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			marker := filepath.Join(t.TempDir(), "golist.sock.starting")
+			tc.setup(t, marker)
+			if got := claimStart(marker); got != tc.want {
+				t.Fatalf("claimStart() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func writeMarker(t *testing.T, marker string, mtime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(marker, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
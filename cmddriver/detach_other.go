@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd
+
+package cmddriver
+
+import "syscall"
+
+func detached() *syscall.SysProcAttr {
+	return nil
+}
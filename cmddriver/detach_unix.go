@@ -0,0 +1,12 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd
+// +build linux darwin freebsd openbsd netbsd
+
+package cmddriver
+
+import "syscall"
+
+// detached puts the server in its own session, away from
+// the client's controlling terminal and process group.
+func detached() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
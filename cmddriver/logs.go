@@ -0,0 +1,114 @@
+package cmddriver
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"marwan.io/golist/logging"
+	"marwan.io/golist/server"
+)
+
+// followInterval is how often golist logs -f
+// checks the log file for new lines.
+const followInterval = 250 * time.Millisecond
+
+func logsCommand(args []string) {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := fs.Bool("f", false, "keep printing lines as the server writes them")
+	asJSON := fs.Bool("json", false, "print the lines as JSON, as they are in the file")
+	request := fs.String("request", "", "only print the lines of the request with this ID")
+	fs.Parse(args)
+	path := server.GetLogPath()
+	if path == "" {
+		fail(fmt.Errorf("the log file is turned off"))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fail(err)
+	}
+	show := func(line string) {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			fmt.Print(line)
+			return
+		}
+		if *request != "" && fields[logging.Field] != *request {
+			return
+		}
+		if *asJSON {
+			fmt.Print(line)
+			return
+		}
+		fmt.Println(formatLine(fields))
+	}
+	r := bufio.NewReader(f)
+	var partial string
+	for {
+		line, err := r.ReadString('\n')
+		partial += line
+		if err == nil {
+			show(partial)
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			fail(err)
+		}
+		if !*follow {
+			return
+		}
+		time.Sleep(followInterval)
+		if rotated(f, path) {
+			// Whatever was left in the old file has been read.
+			f.Close()
+			if f, err = os.Open(path); err != nil {
+				fail(err)
+			}
+			r.Reset(f)
+		}
+	}
+}
+
+// rotated reports whether the file at path is no longer f.
+func rotated(f *os.File, path string) bool {
+	cur, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && !os.SameFile(fi, cur)
+}
+
+// formatLine prints a JSON log line as
+// "time level [request] message key=value...".
+func formatLine(fields map[string]interface{}) string {
+	var b strings.Builder
+	if t, err := time.Parse(time.RFC3339, fmt.Sprint(fields["time"])); err == nil {
+		b.WriteString(t.Local().Format("15:04:05"))
+	}
+	fmt.Fprintf(&b, " %-5v", strings.ToUpper(fmt.Sprint(fields["level"])))
+	if id, ok := fields[logging.Field]; ok {
+		fmt.Fprintf(&b, " [%v]", id)
+	}
+	fmt.Fprintf(&b, " %v", fields["msg"])
+	var keys []string
+	for k := range fields {
+		switch k {
+		case "time", "level", "msg", logging.Field:
+		default:
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %v=%v", k, fields[k])
+	}
+	return b.String()
+}
@@ -0,0 +1,41 @@
+// Package crash recovers panics so that a bug in one
+// request or background job does not take the shared
+// server down with it.
+package crash
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"marwan.io/golist/metrics"
+)
+
+var (
+	count  int64
+	panics = metrics.NewCounter("golist_panics_total", "Panics recovered by the server.")
+)
+
+// Count returns how many panics were recovered.
+func Count() int64 {
+	return atomic.LoadInt64(&count)
+}
+
+// Recover recovers a panic of the calling goroutine, logs it with
+// its stack trace and counts it. If onPanic is not nil, it is called
+// with the panic as an error. Recover must be deferred directly:
+//
+//	defer crash.Recover(lggr, "updating all entries", nil)
+func Recover(lggr *logrus.Logger, what string, onPanic func(err error)) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	atomic.AddInt64(&count, 1)
+	panics.Inc()
+	lggr.Errorf("panic while %v: %v\n%s", what, v, debug.Stack())
+	if onPanic != nil {
+		onPanic(fmt.Errorf("panic while %v: %v", what, v))
+	}
+}
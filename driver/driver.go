@@ -11,7 +11,6 @@ import (
 	"fmt"
 	"go/types"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -19,9 +18,11 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"marwan.io/golist/copy/gopathwalk"
 	"marwan.io/golist/copy/semver"
+	"marwan.io/golist/sched"
 )
 
 // A goTooOldError reports that the go command
@@ -39,6 +40,11 @@ type Config struct {
 	Env        []string
 	BuildFlags []string
 	Tests      bool
+	// Overlay maps file paths to contents that replace
+	// the files on disk, as with go/packages.
+	Overlay map[string][]byte `json:",omitempty"`
+
+	overlayFile string
 }
 
 // A LoadMode specifies the amount of detail to return when loading.
@@ -80,6 +86,16 @@ type driver func(cfg *Config, patterns ...string) (*DriverResponse, error)
 // See driver for more details.
 func GoListDriver(ctx context.Context, cfg *Config) (*DriverResponse, error) {
 	cfg.context = ctx
+	if len(cfg.Overlay) > 0 {
+		dir, err := writeOverlay(cfg)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			os.RemoveAll(dir)
+			cfg.overlayFile = ""
+		}()
+	}
 	patterns := cfg.Patterns
 	var sizes types.Sizes
 	var sizeserr error
@@ -235,6 +251,7 @@ func runNamedQueries(cfg *Config, driver driver, addPkg func(*Package), queries
 	// module cache need special treatment.
 	var matchesMu sync.Mutex
 	var simpleMatches, modCacheMatches []string
+	var walkErr error
 	add := func(root gopathwalk.Root, dir string) {
 		// Walk calls this concurrently; protect the result slices.
 		matchesMu.Lock()
@@ -252,7 +269,10 @@ func runNamedQueries(cfg *Config, driver driver, addPkg func(*Package), queries
 				if err != nil {
 					// This ought to be impossible, since
 					// we found dir in the current module.
-					panic(err)
+					if walkErr == nil {
+						walkErr = err
+					}
+					return
 				}
 				simpleMatches = append(simpleMatches, "./"+rel)
 			case gopathwalk.RootGOPATH, gopathwalk.RootGOROOT:
@@ -263,6 +283,9 @@ func runNamedQueries(cfg *Config, driver driver, addPkg func(*Package), queries
 
 	// startWalk := time.Now()
 	gopathwalk.Walk(roots, add, gopathwalk.Options{ModulesEnabled: modRoot != "", Debug: false})
+	if walkErr != nil {
+		return nil, walkErr
+	}
 	// if debug {
 	// 	log.Printf("%v for walk", time.Since(startWalk))
 	// }
@@ -274,7 +297,7 @@ func runNamedQueries(cfg *Config, driver driver, addPkg func(*Package), queries
 	if modRoot != "" {
 		rel, err := filepath.Rel(cfg.Dir, modRoot)
 		if err != nil {
-			panic(err) // See above.
+			return nil, err // See above.
 		}
 
 		files, err := ioutil.ReadDir(modRoot)
@@ -346,7 +369,7 @@ func runNamedQueries(cfg *Config, driver driver, addPkg func(*Package), queries
 		// We're only trying to look at stuff in the module cache, so
 		// disable the network. This should speed things up, and has
 		// prevented errors in at least one case, #28518.
-		tmpCfg.Env = append(append([]string{"GOPROXY=off"}, cfg.Env...))
+		tmpCfg.Env = append([]string{"GOPROXY=off"}, cfg.Env...)
 
 		var err error
 		tmpCfg.Dir, err = ioutil.TempDir("", "gopackages-modquery")
@@ -362,7 +385,7 @@ func runNamedQueries(cfg *Config, driver driver, addPkg func(*Package), queries
 		// Run the query, using the import paths calculated from the matches above.
 		resp, err := driver(&tmpCfg, imports...)
 		if err != nil {
-			return nil, fmt.Errorf("querying module cache matches: %v", err)
+			return nil, fmt.Errorf("querying module cache matches: %w", err)
 		}
 		addResponse(resp)
 	}
@@ -402,17 +425,17 @@ func roots(cfg *Config) ([]gopathwalk.Root, string, error) {
 
 	var roots []gopathwalk.Root
 	// Always add GOROOT.
-	roots = append(roots, gopathwalk.Root{filepath.Join(goroot, "/src"), gopathwalk.RootGOROOT})
+	roots = append(roots, gopathwalk.Root{Path: filepath.Join(goroot, "/src"), Type: gopathwalk.RootGOROOT})
 	// If modules are enabled, scan the module dir.
 	if modDir != "" {
-		roots = append(roots, gopathwalk.Root{modDir, gopathwalk.RootCurrentModule})
+		roots = append(roots, gopathwalk.Root{Path: modDir, Type: gopathwalk.RootCurrentModule})
 	}
 	// Add either GOPATH/src or GOPATH/pkg/mod, depending on module mode.
 	for _, p := range gopath {
 		if modDir != "" {
-			roots = append(roots, gopathwalk.Root{filepath.Join(p, "/pkg/mod"), gopathwalk.RootModuleCache})
+			roots = append(roots, gopathwalk.Root{Path: filepath.Join(p, "/pkg/mod"), Type: gopathwalk.RootModuleCache})
 		} else {
-			roots = append(roots, gopathwalk.Root{filepath.Join(p, "/src"), gopathwalk.RootGOPATH})
+			roots = append(roots, gopathwalk.Root{Path: filepath.Join(p, "/src"), Type: gopathwalk.RootGOPATH})
 		}
 	}
 
@@ -530,11 +553,49 @@ func golistargs(cfg *Config, words []string) []string {
 		fmt.Sprintf("-deps=%t", cfg.Mode >= LoadImports),
 	}
 	fullargs = append(fullargs, cfg.BuildFlags...)
+	if cfg.overlayFile != "" {
+		fullargs = append(fullargs, "-overlay="+cfg.overlayFile)
+	}
 	fullargs = append(fullargs, "--")
 	fullargs = append(fullargs, words...)
 	return fullargs
 }
 
+// writeOverlay writes the overlay of cfg to a temporary directory
+// in the format of the go command's -overlay flag. The caller
+// removes the returned directory once go list is done.
+func writeOverlay(cfg *Config) (string, error) {
+	dir, err := ioutil.TempDir("", "golist-overlay")
+	if err != nil {
+		return "", err
+	}
+	replace := map[string]string{}
+	var i int
+	for path, contents := range cfg.Overlay {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(cfg.Dir, path)
+		}
+		name := filepath.Join(dir, fmt.Sprintf("%d-%s", i, filepath.Base(path)))
+		i++
+		if err := ioutil.WriteFile(name, contents, 0600); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		replace[path] = name
+	}
+	bts, err := json.Marshal(struct{ Replace map[string]string }{replace})
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	cfg.overlayFile = filepath.Join(dir, "overlay.json")
+	if err := ioutil.WriteFile(cfg.overlayFile, bts, 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
 // golistDriverCurrent uses the "go list" command to expand the
 // pattern words and return metadata for the specified packages.
 // dir may be "" and env may be nil, as per os/exec.Command.
@@ -625,7 +686,7 @@ func golistDriverCurrent(cfg *Config, words ...string) (*DriverResponse, error)
 
 		// Assume go list emits only absolute paths for Dir.
 		if p.Dir != "" && !filepath.IsAbs(p.Dir) {
-			log.Fatalf("internal error: go list returned non-absolute Package.Dir: %s", p.Dir)
+			return nil, fmt.Errorf("internal error: go list returned non-absolute Package.Dir: %s", p.Dir)
 		}
 
 		if p.Export != "" && !filepath.IsAbs(p.Export) {
@@ -693,9 +754,46 @@ func absJoin(dir string, fileses ...[]string) (res []string) {
 
 // invokeGo returns the stdout of a go command invocation.
 func invokeGo(cfg *Config, args ...string) (*bytes.Buffer, error) {
+	release, err := sched.FromContext(cfg.context).Acquire(cfg.context, sched.PriorityFrom(cfg.context))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	start := time.Now()
+	stdout, err := runGo(cfg, args...)
+	if trace, ok := cfg.context.Value(traceKey{}).(func(Invocation)); ok {
+		trace(Invocation{Args: args, Dir: cfg.Dir, Duration: time.Since(start), Err: err})
+	}
+	return stdout, err
+}
+
+// Invocation describes a go command that ran.
+type Invocation struct {
+	Args     []string
+	Dir      string
+	Duration time.Duration
+	Err      error
+}
+
+type traceKey struct{}
+
+// WithTrace returns a context in which trace is called after
+// every go command, after the traces of ctx, if any.
+func WithTrace(ctx context.Context, trace func(Invocation)) context.Context {
+	if outer, ok := ctx.Value(traceKey{}).(func(Invocation)); ok {
+		inner := trace
+		trace = func(inv Invocation) {
+			outer(inv)
+			inner(inv)
+		}
+	}
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+func runGo(cfg *Config, args ...string) (*bytes.Buffer, error) {
 	stdout := new(bytes.Buffer)
 	stderr := new(bytes.Buffer)
-	cmd := exec.CommandContext(cfg.context, "go", args...)
+	cmd := exec.Command("go", args...)
 	// On darwin the cwd gets resolved to the real path, which breaks anything that
 	// expects the working directory to keep the original path, including the
 	// go command when dealing with modules.
@@ -706,13 +804,19 @@ func invokeGo(cfg *Config, args ...string) (*bytes.Buffer, error) {
 	cmd.Dir = cfg.Dir
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
-	if err := cmd.Run(); err != nil {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		// Catastrophic error:
+		// - executable not found
+		return nil, fmt.Errorf("couldn't exec 'go %v': %s %T", args, err, err)
+	}
+	if err := wait(cfg.context, cmd); err != nil {
+		if k, ok := err.(*killedError); ok {
+			return nil, fmt.Errorf("go %v was killed (%w): %s", args, k.reason, stderr)
+		}
 		exitErr, ok := err.(*exec.ExitError)
 		if !ok {
-			// Catastrophic error:
-			// - executable not found
-			// - context cancellation
-			return nil, fmt.Errorf("couldn't exec 'go %v': %s %T", args, err, err)
+			return nil, fmt.Errorf("couldn't run 'go %v': %s %T", args, err, err)
 		}
 
 		// Old go version?
@@ -727,6 +831,59 @@ func invokeGo(cfg *Config, args ...string) (*bytes.Buffer, error) {
 	return stdout, nil
 }
 
+// defaultInvocationTimeout bounds a go command
+// unless the context sets another limit.
+const defaultInvocationTimeout = 5 * time.Minute
+
+type invocationTimeoutKey struct{}
+
+// WithInvocationTimeout returns a context in which
+// every go command is killed after d.
+func WithInvocationTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, invocationTimeoutKey{}, d)
+}
+
+func invocationTimeout(ctx context.Context) time.Duration {
+	if d, ok := ctx.Value(invocationTimeoutKey{}).(time.Duration); ok && d > 0 {
+		return d
+	}
+	return defaultInvocationTimeout
+}
+
+// killedError is returned by wait for a
+// go command it had to kill.
+type killedError struct {
+	reason error
+}
+
+func (k *killedError) Error() string {
+	return "killed: " + k.reason.Error()
+}
+
+// wait waits for cmd to exit. If ctx is done or the invocation
+// timeout passes first, it kills the whole process group of cmd,
+// since killing the go command alone would leave the compilers
+// it started running.
+func wait(ctx context.Context, cmd *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	timeout := invocationTimeout(ctx)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var reason error
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		reason = ctx.Err()
+	case <-timer.C:
+		reason = fmt.Errorf("timed out after %v", timeout)
+	}
+	killProcessGroup(cmd)
+	<-done
+	return &killedError{reason: reason}
+}
+
 func usesExportData(cfg *Config) bool {
 	return LoadTypes <= cfg.Mode && cfg.Mode < LoadAllSyntax
 }
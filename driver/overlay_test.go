@@ -0,0 +1,111 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteOverlay(t *testing.T) {
+	base := t.TempDir()
+	abs := filepath.Join(base, "b", "b.go")
+	cfg := &Config{
+		Dir: base,
+		Overlay: map[string][]byte{
+			"a.go": []byte("package a\n"),
+			abs:    []byte("package b\n"),
+		},
+	}
+	dir, err := writeOverlay(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bts, err := ioutil.ReadFile(cfg.overlayFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var overlay struct{ Replace map[string]string }
+	if err := json.Unmarshal(bts, &overlay); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		filepath.Join(base, "a.go"): "package a\n",
+		abs:                         "package b\n",
+	} {
+		name, ok := overlay.Replace[path]
+		if !ok {
+			t.Errorf("overlay does not replace %v", path)
+			continue
+		}
+		got, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%v is replaced by %q, want %q", path, got, want)
+		}
+	}
+	if len(overlay.Replace) != 2 {
+		t.Errorf("overlay replaces %d files, want 2", len(overlay.Replace))
+	}
+
+	args := golistargs(cfg, []string{"./..."})
+	flag := "-overlay=" + cfg.overlayFile
+	for i, arg := range args {
+		if arg == "--" {
+			t.Fatalf("%v not before -- in %q", flag, args)
+		}
+		if arg == flag {
+			if args[i+1] != "--" {
+				t.Fatalf("%v not last flag in %q", flag, args)
+			}
+			break
+		}
+	}
+}
+
+func TestGoListDriverOverlay(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"go.mod": "module example.com/a\n",
+		"a.go":   "package a\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &Config{
+		Mode:     LoadImports,
+		Dir:      dir,
+		Patterns: []string{"."},
+		Env:      append(os.Environ(), "GOFLAGS=", "GO111MODULE=on"),
+		Overlay: map[string][]byte{
+			"a.go": []byte("package a\n\nimport _ \"errors\"\n"),
+		},
+	}
+	resp, err := GoListDriver(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.overlayFile != "" {
+		t.Errorf("overlayFile = %q after the run, want it reset", cfg.overlayFile)
+	}
+	for _, pkg := range resp.Packages {
+		if pkg.PkgPath != "example.com/a" {
+			continue
+		}
+		if _, ok := pkg.Imports["errors"]; !ok {
+			t.Fatalf("imports of %v = %v, want errors from the overlay", pkg.PkgPath, pkg.Imports)
+		}
+		return
+	}
+	t.Fatalf("example.com/a not in response")
+}
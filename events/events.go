@@ -0,0 +1,123 @@
+// Package events broadcasts changes of the cache to subscribers.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"marwan.io/golist/driver"
+)
+
+// Kind is the kind of an event.
+type Kind string
+
+// Event kinds.
+const (
+	// Refreshed is sent when go list ran for an entry
+	// and its result was stored.
+	Refreshed Kind = "refreshed"
+	// Invalidated is sent when the files of an entry
+	// change or it is invalidated explicitly.
+	Invalidated Kind = "invalidated"
+	// Evicted is sent when an entry is removed from the cache.
+	Evicted Kind = "evicted"
+	// WatchExpired is sent when nothing watches an entry anymore.
+	WatchExpired Kind = "watch_expired"
+	// ListFailed is sent when go list failed for an entry.
+	ListFailed Kind = "list_failed"
+)
+
+// Event describes a change of a cache entry.
+type Event struct {
+	Kind   Kind           `json:"kind"`
+	Time   time.Time      `json:"time"`
+	Config *driver.Config `json:"config"`
+	// Roots are the IDs of the root packages of the entry.
+	Roots []string `json:"roots,omitempty"`
+	// Added and Removed are the IDs of the packages that a
+	// refresh added to or removed from the entry.
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// Reason is why an invalidated entry was invalidated.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// bufferSize is how many events a subscriber may fall behind
+// before its events are dropped.
+const bufferSize = 256
+
+// Bus sends events to subscribers. A nil *Bus drops every event.
+type Bus struct {
+	mu     sync.Mutex
+	subs   map[chan Event]bool
+	closed bool
+}
+
+// NewBus returns a bus without subscribers.
+func NewBus() *Bus {
+	return &Bus{subs: map[chan Event]bool{}}
+}
+
+// Active reports whether anyone is listening, so that
+// publishers can skip computing expensive events.
+func (b *Bus) Active() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs) > 0
+}
+
+// Publish sends e to every subscriber. It never blocks:
+// subscribers that fall behind miss events.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of the events published from now on
+// and a function that cancels the subscription. The channel is
+// closed when the subscription is cancelled or the bus is closed.
+func (b *Bus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, bufferSize)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subs[ch] = true
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.subs[ch] {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close ends every subscription.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
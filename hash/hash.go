@@ -3,6 +3,7 @@ package hash
 import (
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"marwan.io/golist/driver"
 )
 
@@ -18,15 +19,15 @@ func KeyString(cfg *driver.Config) string {
 }
 
 // Parse takes an encoded key and returns it a Config.
-func Parse(key []byte) *driver.Config {
+func Parse(key []byte) (*driver.Config, error) {
 	var cfg driver.Config
 	bts, err := base64.StdEncoding.DecodeString(string(key))
 	if err != nil {
-		panic("bad file put into db: " + string(key))
+		return nil, fmt.Errorf("bad key put into db: %q", key)
 	}
 	err = json.Unmarshal(bts, &cfg)
 	if err != nil {
-		panic("bad json put into db: " + string(bts))
+		return nil, fmt.Errorf("bad json put into db: %s", bts)
 	}
-	return &cfg
+	return &cfg, nil
 }
@@ -0,0 +1,172 @@
+// Package logging ties the log lines of a request together with
+// a request ID and writes the server's logs to a rotated file.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Field is the log field holding the request ID.
+const Field = "request_id"
+
+// NewID returns a random request ID.
+func NewID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+type idKey struct{}
+
+// WithID returns a context carrying the request ID id.
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idKey{}, id)
+}
+
+// ID returns the request ID of ctx, if any.
+func ID(ctx context.Context) string {
+	id, _ := ctx.Value(idKey{}).(string)
+	return id
+}
+
+// From returns lggr with the request ID of ctx as a field.
+func From(ctx context.Context, lggr *logrus.Logger) *logrus.Entry {
+	return Entry(lggr, ID(ctx))
+}
+
+// Entry returns lggr with id as the request ID field,
+// unless id is empty.
+func Entry(lggr *logrus.Logger, id string) *logrus.Entry {
+	if id == "" {
+		return logrus.NewEntry(lggr)
+	}
+	return lggr.WithField(Field, id)
+}
+
+// Hook writes the entries of level or more
+// severe ones to w, formatted by f.
+type Hook struct {
+	w     io.Writer
+	f     logrus.Formatter
+	level logrus.Level
+}
+
+// NewHook returns a Hook writing to w.
+func NewHook(w io.Writer, f logrus.Formatter, level logrus.Level) *Hook {
+	return &Hook{w: w, f: f, level: level}
+}
+
+// Levels implements logrus.Hook.
+func (h *Hook) Levels() []logrus.Level {
+	return logrus.AllLevels[:h.level+1]
+}
+
+// Fire implements logrus.Hook.
+func (h *Hook) Fire(e *logrus.Entry) error {
+	bts, err := h.f.Format(e)
+	if err != nil {
+		return err
+	}
+	_, err = h.w.Write(bts)
+	return err
+}
+
+// File is a log file that is rotated once it grows beyond
+// its maximum size: path is renamed to path.1, path.1 to
+// path.2 and so on, and the oldest backup is removed.
+type File struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenFile opens the log file at path for appending.
+// A maxSize of zero means the file is never rotated.
+func OpenFile(path string, maxSize int64, backups int) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	lf := &File{path: path, maxSize: maxSize, backups: backups}
+	return lf, lf.open()
+}
+
+func (lf *File) open() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.f, lf.size = f, fi.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first
+// if p would make it exceed its maximum size.
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if lf.maxSize > 0 && lf.size > 0 && lf.size+int64(len(p)) > lf.maxSize {
+		if err := lf.rotate(); err != nil {
+			return 0, fmt.Errorf("could not rotate %v: %v", lf.path, err)
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+func (lf *File) rotate() error {
+	if err := lf.f.Close(); err != nil {
+		return err
+	}
+	lf.f = nil
+	if lf.backups > 0 {
+		os.Remove(Backup(lf.path, lf.backups))
+		for i := lf.backups - 1; i > 0; i-- {
+			os.Rename(Backup(lf.path, i), Backup(lf.path, i+1))
+		}
+		if err := os.Rename(lf.path, Backup(lf.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(lf.path); err != nil {
+		return err
+	}
+	return lf.open()
+}
+
+// Close closes the file.
+func (lf *File) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
+
+// Backup returns the path of the nth backup of the log file at path.
+func Backup(path string, n int) string {
+	return fmt.Sprintf("%v.%d", path, n)
+}
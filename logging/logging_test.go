@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileRotation(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		maxSize int64
+		backups int
+		writes  []string
+		// want are the contents of the file and of its backups.
+		want []string
+	}{
+		{
+			name:    "no rotation",
+			maxSize: 0,
+			backups: 2,
+			writes:  []string{"aaaa\n", "bbbb\n", "cccc\n"},
+			want:    []string{"aaaa\nbbbb\ncccc\n"},
+		},
+		{
+			name:    "rotates beyond max size",
+			maxSize: 10,
+			backups: 2,
+			writes:  []string{"aaaa\n", "bbbb\n", "cccc\n"},
+			want:    []string{"cccc\n", "aaaa\nbbbb\n"},
+		},
+		{
+			name:    "drops the oldest backup",
+			maxSize: 5,
+			backups: 2,
+			writes:  []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n"},
+			want:    []string{"dddd\n", "cccc\n", "bbbb\n"},
+		},
+		{
+			name:    "no backups",
+			maxSize: 5,
+			backups: 0,
+			writes:  []string{"aaaa\n", "bbbb\n"},
+			want:    []string{"bbbb\n"},
+		},
+		{
+			name:    "oversized write",
+			maxSize: 2,
+			backups: 1,
+			writes:  []string{"aaaa\n"},
+			want:    []string{"aaaa\n"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "logs", "golist.log")
+			lf, err := OpenFile(path, tc.maxSize, tc.backups)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tc.writes {
+				if _, err := lf.Write([]byte(w)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := lf.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tc.want {
+				name := path
+				if i > 0 {
+					name = Backup(path, i)
+				}
+				got, err := ioutil.ReadFile(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("%v = %q, want %q", filepath.Base(name), got, want)
+				}
+			}
+			if _, err := os.Stat(Backup(path, len(tc.want))); !os.IsNotExist(err) {
+				t.Errorf("%v exists", Backup(path, len(tc.want)))
+			}
+		})
+	}
+}
+
+func TestFileWriteAfterClose(t *testing.T) {
+	lf, err := OpenFile(filepath.Join(t.TempDir(), "golist.log"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.Close()
+	if _, err := lf.Write([]byte("a")); err != os.ErrClosed {
+		t.Fatalf("Write() = %v, want %v", err, os.ErrClosed)
+	}
+}
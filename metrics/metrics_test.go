@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		labels []string
+		add    func(c *Counter)
+		want   string
+	}{
+		{
+			name: "no labels",
+			add:  func(c *Counter) {},
+			want: "# HELP c Help.\n# TYPE c counter\nc 0\n",
+		},
+		{
+			name: "increments",
+			add: func(c *Counter) {
+				c.Inc()
+				c.Add(1.5)
+			},
+			want: "# HELP c Help.\n# TYPE c counter\nc 2.5\n",
+		},
+		{
+			name:   "labels are sorted by value",
+			labels: []string{"mode", "outcome"},
+			add: func(c *Counter) {
+				c.Inc("files", "ok")
+				c.Inc("deps", "error")
+				c.Inc("files", "ok")
+			},
+			want: "# HELP c Help.\n# TYPE c counter\n" +
+				"c{mode=\"deps\",outcome=\"error\"} 1\n" +
+				"c{mode=\"files\",outcome=\"ok\"} 2\n",
+		},
+		{
+			name:   "missing and escaped values",
+			labels: []string{"a", "b"},
+			add: func(c *Counter) {
+				c.Inc("x\"y\\z\n")
+			},
+			want: "# HELP c Help.\n# TYPE c counter\n" +
+				"c{a=\"x\\\"y\\\\z\\n\",b=\"\"} 1\n",
+		},
+	} {
+		r := &Registry{}
+		c := r.NewCounter("c", "Help.", tc.labels...)
+		tc.add(c)
+		var b strings.Builder
+		r.Write(&b)
+		if got := b.String(); got != tc.want {
+			t.Errorf("%v: got\n%s\nwant\n%s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		values []float64
+		want   string
+	}{
+		{
+			name: "empty",
+			want: "# HELP h Help.\n# TYPE h histogram\n" +
+				"h_bucket{le=\"0.5\"} 0\n" +
+				"h_bucket{le=\"1\"} 0\n" +
+				"h_bucket{le=\"+Inf\"} 0\n" +
+				"h_sum 0\n" +
+				"h_count 0\n",
+		},
+		{
+			name:   "cumulative buckets",
+			values: []float64{0.1, 0.5, 0.75, 3},
+			want: "# HELP h Help.\n# TYPE h histogram\n" +
+				"h_bucket{le=\"0.5\"} 2\n" +
+				"h_bucket{le=\"1\"} 3\n" +
+				"h_bucket{le=\"+Inf\"} 4\n" +
+				"h_sum 4.35\n" +
+				"h_count 4\n",
+		},
+	} {
+		r := &Registry{}
+		h := r.NewHistogram("h", "Help.", []float64{0.5, 1})
+		for _, v := range tc.values {
+			h.Observe(v)
+		}
+		var b strings.Builder
+		r.Write(&b)
+		if got := b.String(); got != tc.want {
+			t.Errorf("%v: got\n%s\nwant\n%s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	for _, tc := range []struct {
+		v    float64
+		want string
+	}{
+		{v: 0, want: "0"},
+		{v: 0.005, want: "0.005"},
+		{v: 1e21, want: "1e+21"},
+		{v: math.Inf(1), want: "+Inf"},
+		{v: math.Inf(-1), want: "-Inf"},
+		{v: math.NaN(), want: "NaN"},
+	} {
+		if got := formatFloat(tc.v); got != tc.want {
+			t.Errorf("formatFloat(%v) = %q, want %q", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := &Registry{}
+	r.NewCounter("c", "Multi\nline \\ help.").Inc()
+	r.NewGaugeFunc("g", "Help.", func() float64 { return 0.25 })
+	rec := httptest.NewRecorder()
+	r.Handler()(rec, httptest.NewRequest("GET", "/metrics", nil))
+	want := "# HELP c Multi\\nline \\\\ help.\n# TYPE c counter\nc 1\n" +
+		"# HELP g Help.\n# TYPE g gauge\ng 0.25\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
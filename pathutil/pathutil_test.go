@@ -0,0 +1,25 @@
+package pathutil
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestWithin(t *testing.T) {
+	root := filepath.FromSlash("/a/b")
+	for _, tc := range []struct {
+		path string
+		want bool
+	}{
+		{path: "/a/b", want: true},
+		{path: "/a/b/c/d.go", want: true},
+		{path: "/a/b/..foo", want: true},
+		{path: "/a", want: false},
+		{path: "/a/bc", want: false},
+		{path: "/a/c/d.go", want: false},
+	} {
+		if got := Within(root, filepath.FromSlash(tc.path)); got != tc.want {
+			t.Errorf("Within(%v, %v) = %v, want %v", root, tc.path, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package sched bounds how many go commands run at once.
+//
+// Requests for a slot wait in one of two lanes: interactive requests,
+// which a client is waiting for, always go before background
+// refreshes. Only the interactive lane is bounded, since background
+// work is already limited by the few goroutines doing it and would
+// rather wait than fail.
+package sched
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Priority is the lane a go command waits in.
+type Priority int
+
+// Priorities, from the most to the least urgent.
+const (
+	Interactive Priority = iota
+	Background
+	numLanes
+)
+
+func (p Priority) String() string {
+	if p == Interactive {
+		return "interactive"
+	}
+	return "background"
+}
+
+// ErrBusy is returned when too many interactive
+// go commands are already waiting.
+var ErrBusy = errors.New("server busy: too many go commands queued")
+
+// Scheduler hands out slots to run go commands.
+// A nil *Scheduler never waits.
+type Scheduler struct {
+	max        int
+	queueLimit int
+
+	mu      sync.Mutex
+	running int
+	lanes   [numLanes][]chan struct{}
+}
+
+// New returns a scheduler running up to max go commands at once
+// and queueing up to queueLimit interactive ones. A queueLimit
+// of zero or less means no limit.
+func New(max, queueLimit int) *Scheduler {
+	if max < 1 {
+		max = 1
+	}
+	return &Scheduler{max: max, queueLimit: queueLimit}
+}
+
+// Acquire waits for a slot in lane p. The caller must call the
+// returned function once its go command is done.
+func (s *Scheduler) Acquire(ctx context.Context, p Priority) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	if p < 0 || p >= numLanes {
+		p = Background
+	}
+	s.mu.Lock()
+	if s.running < s.max && s.queued() == 0 {
+		s.running++
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	if p == Interactive && s.queueLimit > 0 && len(s.lanes[p]) >= s.queueLimit {
+		s.mu.Unlock()
+		return nil, ErrBusy
+	}
+	ready := make(chan struct{})
+	s.lanes[p] = append(s.lanes[p], ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return s.release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, ch := range s.lanes[p] {
+			if ch == ready {
+				s.lanes[p] = append(s.lanes[p][:i], s.lanes[p][i+1:]...)
+				return nil, ctx.Err()
+			}
+		}
+		// We were handed a slot as we gave up: pass it on.
+		s.running--
+		s.dispatch()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	s.dispatch()
+}
+
+// dispatch hands free slots to the most urgent waiters.
+// It must be called with s.mu held.
+func (s *Scheduler) dispatch() {
+	for p := range s.lanes {
+		for s.running < s.max && len(s.lanes[p]) > 0 {
+			close(s.lanes[p][0])
+			s.lanes[p] = s.lanes[p][1:]
+			s.running++
+		}
+	}
+}
+
+func (s *Scheduler) queued() int {
+	var n int
+	for _, lane := range s.lanes {
+		n += len(lane)
+	}
+	return n
+}
+
+// Stats describes the load of a scheduler.
+type Stats struct {
+	Max     int
+	Running int
+	// Queued is the number of waiting go commands by lane.
+	Queued map[Priority]int
+}
+
+// Stats returns the current load of s.
+func (s *Scheduler) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := Stats{Max: s.max, Running: s.running, Queued: map[Priority]int{}}
+	for p, lane := range s.lanes {
+		st.Queued[Priority(p)] = len(lane)
+	}
+	return st
+}
+
+type schedulerKey struct{}
+
+type priorityKey struct{}
+
+// WithScheduler returns a context whose go commands are run by s.
+func WithScheduler(ctx context.Context, s *Scheduler) context.Context {
+	return context.WithValue(ctx, schedulerKey{}, s)
+}
+
+// FromContext returns the scheduler of ctx, or nil.
+func FromContext(ctx context.Context) *Scheduler {
+	s, _ := ctx.Value(schedulerKey{}).(*Scheduler)
+	return s
+}
+
+// WithPriority returns a context whose go commands wait in lane p.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFrom returns the priority of ctx,
+// which is Background unless set otherwise.
+func PriorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return Background
+}
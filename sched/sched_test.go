@@ -0,0 +1,156 @@
+package sched
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n go commands wait in lane p.
+func waitQueued(t *testing.T, s *Scheduler, p Priority, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().Queued[p] != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v lane has %d waiters, want %d", p, s.Stats().Queued[p], n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAcquirePriority(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		queued []Priority
+		want   []int
+	}{
+		{
+			name:   "interactive first",
+			queued: []Priority{Background, Interactive},
+			want:   []int{1, 0},
+		},
+		{
+			name:   "fifo within a lane",
+			queued: []Priority{Background, Background, Interactive, Interactive},
+			want:   []int{2, 3, 0, 1},
+		},
+		{
+			name:   "unknown priority is background",
+			queued: []Priority{Priority(7), Interactive},
+			want:   []int{1, 0},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(1, 0)
+			release, err := s.Acquire(context.Background(), Interactive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			granted := make(chan int)
+			queued := map[Priority]int{}
+			for i, p := range tc.queued {
+				go func(i int, p Priority) {
+					release, err := s.Acquire(context.Background(), p)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					granted <- i
+					release()
+				}(i, p)
+				lane := p
+				if lane != Interactive {
+					lane = Background
+				}
+				queued[lane]++
+				waitQueued(t, s, lane, queued[lane])
+			}
+			release()
+			var got []int
+			for range tc.queued {
+				got = append(got, <-granted)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("granted %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAcquireBusy(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		queueLimit int
+		queued     int
+		p          Priority
+		wantErr    error
+	}{
+		{name: "room left", queueLimit: 2, queued: 1, p: Interactive},
+		{name: "queue full", queueLimit: 2, queued: 2, p: Interactive, wantErr: ErrBusy},
+		{name: "background is unbounded", queueLimit: 2, queued: 2, p: Background},
+		{name: "no limit", queueLimit: 0, queued: 5, p: Interactive},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(1, tc.queueLimit)
+			release, err := s.Acquire(context.Background(), Interactive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer release()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			for i := 0; i < tc.queued; i++ {
+				go s.Acquire(ctx, Interactive)
+				waitQueued(t, s, Interactive, i+1)
+			}
+			// A short timeout tells a queued Acquire from a refused one.
+			actx, acancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer acancel()
+			_, err = s.Acquire(actx, tc.p)
+			want := tc.wantErr
+			if want == nil {
+				want = context.DeadlineExceeded
+			}
+			if err != want {
+				t.Fatalf("Acquire() = %v, want %v", err, want)
+			}
+		})
+	}
+}
+
+func TestAcquireCancelWhileQueued(t *testing.T) {
+	for _, p := range []Priority{Interactive, Background} {
+		t.Run(p.String(), func(t *testing.T) {
+			s := New(1, 0)
+			release, err := s.Acquire(context.Background(), Interactive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			errc := make(chan error)
+			go func() {
+				_, err := s.Acquire(ctx, p)
+				errc <- err
+			}()
+			waitQueued(t, s, p, 1)
+			cancel()
+			if err := <-errc; err != context.Canceled {
+				t.Fatalf("Acquire() = %v, want %v", err, context.Canceled)
+			}
+			if n := s.Stats().Queued[p]; n != 0 {
+				t.Fatalf("%d waiters left after cancellation", n)
+			}
+			release()
+			if st := s.Stats(); st.Running != 0 {
+				t.Fatalf("%d go commands running after release, want 0", st.Running)
+			}
+			// The slot is free again.
+			release, err = s.Acquire(context.Background(), p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			release()
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigEnv overrides the path of the configuration file.
+const ConfigEnv = "GOLIST_CONFIG"
+
+// Config is the configuration of the server. It is read from a JSON
+// file in the user's config directory, and every setting can be
+// overridden by an environment variable named after its JSON key,
+// upper cased and prefixed with GOLIST_, e.g. GOLIST_WATCH_EXPIRY.
+type Config struct {
+	// Socket and DB are the paths of the server's
+	// unix socket and database.
+	Socket string `json:"socket"`
+	DB     string `json:"db"`
+	// LogLevel is one of debug, info, warn and error.
+	// It applies to the logs written to stderr.
+	LogLevel string `json:"log_level"`
+	// LogFile is where the server writes JSON logs of
+	// LogFileLevel. An empty path turns the file off.
+	LogFile      string `json:"log_file"`
+	LogFileLevel string `json:"log_file_level"`
+	// LogMaxSize is the size in megabytes beyond which the
+	// log file is rotated, keeping LogBackups old files.
+	LogMaxSize int `json:"log_max_size"`
+	LogBackups int `json:"log_backups"`
+	// Poll, PollInterval and Ignore configure the file watchers.
+	// See watcher.Options.
+	Poll         bool     `json:"poll"`
+	PollInterval Duration `json:"poll_interval"`
+	Ignore       []string `json:"ignore"`
+	// WatchExpiry is how long an entry is watched
+	// after its last request.
+	WatchExpiry Duration `json:"watch_expiry"`
+	// RefreshTimeout bounds the refresh of
+	// an entry after its files changed.
+	RefreshTimeout Duration `json:"refresh_timeout"`
+	// UpdateOnStart revalidates every entry when the server starts.
+	UpdateOnStart bool `json:"update_on_start"`
+	// MaxEntries is the most entries the cache keeps.
+	// Zero means no limit.
+	MaxEntries int `json:"max_entries"`
+	// MaxProcs, MaxQueue and GoTimeout bound the go commands
+	// of the server. See Options.
+	MaxProcs  int      `json:"max_procs"`
+	MaxQueue  int      `json:"max_queue"`
+	GoTimeout Duration `json:"go_timeout"`
+	// IdleTimeout and DrainTimeout control when and how
+	// the server exits. See Options.
+	IdleTimeout  Duration `json:"idle_timeout"`
+	DrainTimeout Duration `json:"drain_timeout"`
+	// HistorySize is how many of the latest
+	// requests /debug/requests lists.
+	HistorySize int `json:"history_size"`
+}
+
+// Duration is a time.Duration written
+// as a string such as "1h30m" in JSON.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(bts []byte) error {
+	var s string
+	if err := json.Unmarshal(bts, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"1h30m\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// DefaultConfig returns the configuration used
+// when neither the file nor env set anything.
+// It fails if there is nowhere to put the
+// socket or the database by default.
+func DefaultConfig() (Config, error) {
+	socket, err := defaultSocketPath()
+	if err != nil {
+		return Config{}, err
+	}
+	db, err := defaultDBPath()
+	if err != nil {
+		return Config{}, err
+	}
+	return Config{
+		Socket:         socket,
+		DB:             db,
+		LogLevel:       "warn",
+		LogFile:        defaultLogPath(db),
+		LogFileLevel:   "info",
+		LogMaxSize:     10,
+		LogBackups:     3,
+		PollInterval:   Duration(2 * time.Second),
+		WatchExpiry:    Duration(time.Hour),
+		RefreshTimeout: Duration(30 * time.Second),
+		UpdateOnStart:  true,
+		MaxProcs:       runtime.NumCPU(),
+		MaxQueue:       32,
+		GoTimeout:      Duration(5 * time.Minute),
+		DrainTimeout:   Duration(defaultDrainTimeout),
+		HistorySize:    defaultHistorySize,
+	}, nil
+}
+
+// ConfigPath returns the path of the configuration file:
+// golist/config.json in the user's config directory
+// ($XDG_CONFIG_HOME on Linux).
+func ConfigPath() string {
+	if p := os.Getenv(ConfigEnv); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "golist", "config.json")
+}
+
+// LoadConfig returns the defaults overridden by
+// the configuration file, if any, and then by env.
+func LoadConfig() (Config, error) {
+	cfg, err := DefaultConfig()
+	if err != nil {
+		return cfg, err
+	}
+	if path := ConfigPath(); path != "" {
+		bts, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return cfg, err
+		}
+		if err == nil {
+			dec := json.NewDecoder(bytes.NewReader(bts))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&cfg); err != nil {
+				return cfg, fmt.Errorf("%v: %v", path, err)
+			}
+		}
+	}
+	return cfg, applyEnv(&cfg)
+}
+
+// applyEnv overrides the settings of cfg with their env variables.
+// It skips the variables it cannot parse, and returns the first error.
+func applyEnv(cfg *Config) error {
+	var first error
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := "GOLIST_" + strings.ToUpper(field.Tag.Get("json"))
+		val := os.Getenv(name)
+		if val == "" {
+			continue
+		}
+		var parsed interface{}
+		var err error
+		switch v.Field(i).Interface().(type) {
+		case string:
+			parsed = val
+		case bool:
+			parsed, err = strconv.ParseBool(val)
+		case int:
+			parsed, err = strconv.Atoi(val)
+		case Duration:
+			var d time.Duration
+			d, err = time.ParseDuration(val)
+			parsed = Duration(d)
+		case []string:
+			parsed = SplitList(val)
+		default:
+			continue
+		}
+		if err != nil {
+			if first == nil {
+				first = fmt.Errorf("%v: %v", name, err)
+			}
+			continue
+		}
+		v.Field(i).Set(reflect.ValueOf(parsed))
+	}
+	return first
+}
+
+// SplitList splits a comma separated list,
+// dropping the empty elements.
+func SplitList(s string) []string {
+	var list []string
+	for _, elem := range strings.Split(s, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			list = append(list, elem)
+		}
+	}
+	return list
+}
+
+var (
+	configOnce sync.Once
+	config     Config
+)
+
+// loadedConfig returns the configuration, read once. If it cannot
+// be loaded, it logs why and falls back to the defaults with the env
+// overrides that do parse. RunServer and golist config fail instead.
+func loadedConfig() Config {
+	configOnce.Do(func() {
+		var err error
+		if config, err = LoadConfig(); err != nil {
+			log.Printf("golist: could not load config, using the defaults: %v", err)
+			config, _ = DefaultConfig()
+			applyEnv(&config)
+		}
+	})
+	return config
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		env     map[string]string
+		want    func(cfg *Config)
+		wantErr bool
+	}{
+		{
+			name: "every kind of setting",
+			env: map[string]string{
+				"GOLIST_SOCKET":       "/run/golist.sock",
+				"GOLIST_POLL":         "true",
+				"GOLIST_MAX_ENTRIES":  "10",
+				"GOLIST_WATCH_EXPIRY": "5m",
+				"GOLIST_IGNORE":       "gen/, *.tmp ,",
+			},
+			want: func(cfg *Config) {
+				cfg.Socket = "/run/golist.sock"
+				cfg.Poll = true
+				cfg.MaxEntries = 10
+				cfg.WatchExpiry = Duration(5 * time.Minute)
+				cfg.Ignore = []string{"gen/", "*.tmp"}
+			},
+		},
+		{
+			name: "bad values are skipped",
+			env: map[string]string{
+				"GOLIST_MAX_PROCS":  "many",
+				"GOLIST_GO_TIMEOUT": "soon",
+				"GOLIST_MAX_QUEUE":  "4",
+			},
+			want: func(cfg *Config) {
+				cfg.MaxQueue = 4
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := DefaultConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := cfg
+			tc.want(&want)
+			err = applyEnv(&cfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("applyEnv() = %v, want error %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(cfg, want) {
+				t.Fatalf("got\n%+v\nwant\n%+v", cfg, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		file    string
+		env     map[string]string
+		want    func(cfg *Config)
+		wantErr bool
+	}{
+		{
+			name: "no file",
+			want: func(cfg *Config) {},
+		},
+		{
+			name: "file",
+			file: `{"max_entries": 5, "watch_expiry": "2h", "ignore": ["gen/"]}`,
+			want: func(cfg *Config) {
+				cfg.MaxEntries = 5
+				cfg.WatchExpiry = Duration(2 * time.Hour)
+				cfg.Ignore = []string{"gen/"}
+			},
+		},
+		{
+			name: "env overrides the file",
+			file: `{"max_entries": 5}`,
+			env:  map[string]string{"GOLIST_MAX_ENTRIES": "7"},
+			want: func(cfg *Config) {
+				cfg.MaxEntries = 7
+			},
+		},
+		{
+			name:    "unknown setting",
+			file:    `{"max_entry": 5}`,
+			wantErr: true,
+		},
+		{
+			name:    "duration as a number",
+			file:    `{"watch_expiry": 3600}`,
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if tc.file != "" {
+				if err := ioutil.WriteFile(path, []byte(tc.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv(ConfigEnv, path)
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := LoadConfig()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("LoadConfig() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := DefaultConfig()
+			tc.want(&want)
+			if !reflect.DeepEqual(cfg, want) {
+				t.Fatalf("got\n%+v\nwant\n%+v", cfg, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// ErrorCode classifies why a request failed.
+type ErrorCode string
+
+// Error codes returned by the server.
+const (
+	CodeDriverFailure ErrorCode = "driver_failure"
+	CodeBadRequest    ErrorCode = "bad_request"
+	CodeTimeout       ErrorCode = "timeout"
+	CodeOverloaded    ErrorCode = "server_overloaded"
+	// CodeVersionMismatch means the client and the server
+	// come from different binaries: the client should
+	// restart the server and try again.
+	CodeVersionMismatch ErrorCode = "version_mismatch"
+	// CodeInternal means the server hit a bug
+	// while handling the request.
+	CodeInternal ErrorCode = "internal_error"
+)
+
+// Error is the body of every failed response.
+// It is sent with a non-200 status code.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// RequestID is the ID of the failed request, from
+	// its RequestIDHeader, to look it up in the server's logs.
+	RequestID string `json:"-"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *Error) status() int {
+	switch e.Code {
+	case CodeBadRequest:
+		return http.StatusBadRequest
+	case CodeTimeout:
+		return http.StatusGatewayTimeout
+	case CodeOverloaded:
+		return http.StatusServiceUnavailable
+	case CodeVersionMismatch:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, code ErrorCode, err error) {
+	(&Error{Code: code, Message: err.Error()}).write(w)
+}
+
+func (e *Error) write(w http.ResponseWriter) {
+	setOutcome(w, e.Code)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.status())
+	json.NewEncoder(w).Encode(e)
+}
+
+// ReadError returns the error carried by a failed response.
+// Responses that do not hold an error envelope, for example
+// from an older server, are reported as driver failures.
+func ReadError(resp *http.Response) *Error {
+	bts, _ := ioutil.ReadAll(resp.Body)
+	e := &Error{}
+	if err := json.Unmarshal(bts, e); err != nil || e.Code == "" {
+		e = &Error{
+			Code:    CodeDriverFailure,
+			Message: fmt.Sprintf("%s: %s", resp.Status, bts),
+		}
+	}
+	e.RequestID = resp.Header.Get(RequestIDHeader)
+	return e
+}
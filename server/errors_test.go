@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorWrite(t *testing.T) {
+	for _, tc := range []struct {
+		code ErrorCode
+		want int
+	}{
+		{code: CodeBadRequest, want: http.StatusBadRequest},
+		{code: CodeTimeout, want: http.StatusGatewayTimeout},
+		{code: CodeOverloaded, want: http.StatusServiceUnavailable},
+		{code: CodeVersionMismatch, want: http.StatusConflict},
+		{code: CodeDriverFailure, want: http.StatusInternalServerError},
+		{code: CodeInternal, want: http.StatusInternalServerError},
+	} {
+		rec := httptest.NewRecorder()
+		(&Error{Code: tc.code, Message: "msg", RequestID: "id"}).write(rec)
+		if rec.Code != tc.want {
+			t.Errorf("%v: status = %d, want %d", tc.code, rec.Code, tc.want)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%v: Content-Type = %q", tc.code, ct)
+		}
+		// The request ID travels in a header, not in the body.
+		want := `{"code":"` + string(tc.code) + `","message":"msg"}` + "\n"
+		if got := rec.Body.String(); got != want {
+			t.Errorf("%v: body = %q, want %q", tc.code, got, want)
+		}
+	}
+}
+
+func TestReadError(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		want   Error
+	}{
+		{
+			name:   "envelope",
+			status: http.StatusConflict,
+			body:   `{"code":"version_mismatch","message":"restart"}`,
+			want:   Error{Code: CodeVersionMismatch, Message: "restart", RequestID: "id"},
+		},
+		{
+			name:   "plain text",
+			status: http.StatusInternalServerError,
+			body:   "go list failed",
+			want:   Error{Code: CodeDriverFailure, Message: "500 Internal Server Error: go list failed", RequestID: "id"},
+		},
+		{
+			name:   "json without code",
+			status: http.StatusBadGateway,
+			body:   `{"message":"proxy"}`,
+			want:   Error{Code: CodeDriverFailure, Message: `502 Bad Gateway: {"message":"proxy"}`, RequestID: "id"},
+		},
+	} {
+		resp := &http.Response{
+			Status:     fmt.Sprintf("%d %s", tc.status, http.StatusText(tc.status)),
+			StatusCode: tc.status,
+			Header:     http.Header{RequestIDHeader: []string{"id"}},
+			Body:       ioutil.NopCloser(strings.NewReader(tc.body)),
+		}
+		if got := ReadError(resp); *got != tc.want {
+			t.Errorf("%v: ReadError() = %+v, want %+v", tc.name, *got, tc.want)
+		}
+	}
+}
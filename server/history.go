@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"marwan.io/golist/cache"
+	"marwan.io/golist/driver"
+	"marwan.io/golist/hash"
+	"marwan.io/golist/logging"
+)
+
+// RequestRecord describes a finished driver request,
+// as listed by /debug/requests.
+type RequestRecord struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Duration string    `json:"duration"`
+	// Key identifies the entry of Config for /debug/explain.
+	Key    string         `json:"key,omitempty"`
+	Config *driver.Config `json:"config,omitempty"`
+	// Overlay lists the files of the request's overlay,
+	// whose contents are left out of Config.
+	Overlay []string `json:"overlay,omitempty"`
+	// Outcome is how the cache served the request:
+	// hit, miss, stale, coalesced or bypass.
+	Outcome  cache.Outcome   `json:"outcome,omitempty"`
+	Commands []CommandRecord `json:"commands"`
+	Status   int             `json:"status"`
+	// Size is the size of the response body in bytes.
+	Size  int    `json:"size"`
+	Error *Error `json:"error,omitempty"`
+
+	// mu guards the record, which the go list run of a
+	// request that went away may still add commands to.
+	mu sync.Mutex
+}
+
+// CommandRecord describes a go command run for a request.
+type CommandRecord struct {
+	Args     []string `json:"args"`
+	Dir      string   `json:"dir"`
+	Duration string   `json:"duration"`
+	Error    string   `json:"error,omitempty"`
+}
+
+func (rec *RequestRecord) setConfig(cfg *driver.Config) {
+	if rec == nil {
+		return
+	}
+	c := *cfg
+	c.Overlay = nil
+	rec.mu.Lock()
+	rec.Key = hash.KeyString(&c)
+	rec.Config = &c
+	for file := range cfg.Overlay {
+		rec.Overlay = append(rec.Overlay, file)
+	}
+	sort.Strings(rec.Overlay)
+	rec.mu.Unlock()
+}
+
+func (rec *RequestRecord) setOutcome(o cache.Outcome) {
+	rec.mu.Lock()
+	rec.Outcome = o
+	rec.mu.Unlock()
+}
+
+func (rec *RequestRecord) addCommand(inv driver.Invocation) {
+	cmd := CommandRecord{Args: inv.Args, Dir: inv.Dir, Duration: inv.Duration.String()}
+	if inv.Err != nil {
+		cmd.Error = inv.Err.Error()
+	}
+	rec.mu.Lock()
+	rec.Commands = append(rec.Commands, cmd)
+	rec.mu.Unlock()
+}
+
+type recordKey struct{}
+
+// requestRecord returns the record of the request of ctx, if any.
+func requestRecord(ctx context.Context) *RequestRecord {
+	rec, _ := ctx.Value(recordKey{}).(*RequestRecord)
+	return rec
+}
+
+const defaultHistorySize = 100
+
+// history keeps the records of the latest requests in a ring.
+type history struct {
+	mu      sync.Mutex
+	records []*RequestRecord
+	next    int
+}
+
+func newHistory(size int) *history {
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	return &history{records: make([]*RequestRecord, 0, size)}
+}
+
+func (h *history) add(rec *RequestRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.records) < cap(h.records) {
+		h.records = append(h.records, rec)
+		return
+	}
+	h.records[h.next] = rec
+	h.next = (h.next + 1) % len(h.records)
+}
+
+// list returns the records, the latest first.
+func (h *history) list() []*RequestRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]*RequestRecord, 0, len(h.records))
+	for i := len(h.records) - 1; i >= 0; i-- {
+		list = append(list, h.records[(h.next+i)%len(h.records)])
+	}
+	return list
+}
+
+// record adds the requests handled by next to the history. It
+// must run inside withRequestID, and outside of timer, which
+// expects to see the ResponseWriter it passes on.
+func (h *history) record(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &RequestRecord{ID: logging.ID(r.Context()), Time: time.Now(), Commands: []CommandRecord{}}
+		ctx := context.WithValue(r.Context(), recordKey{}, rec)
+		ctx = cache.WithOutcome(ctx, rec.setOutcome)
+		ctx = driver.WithTrace(ctx, rec.addCommand)
+		hw := &historyWriter{ResponseWriter: w}
+		defer func() {
+			rec.mu.Lock()
+			rec.Duration = time.Since(rec.Time).String()
+			rec.Status = hw.status
+			rec.Size = hw.size
+			if hw.status >= http.StatusBadRequest {
+				e := &Error{}
+				if err := json.Unmarshal(hw.body.Bytes(), e); err == nil && e.Code != "" {
+					rec.Error = e
+				}
+			}
+			rec.mu.Unlock()
+			h.add(rec)
+		}()
+		next(hw, r.WithContext(ctx))
+	}
+}
+
+// maxErrorBody bounds how much of a failed
+// response is kept to read its Error.
+const maxErrorBody = 4 << 10
+
+// historyWriter records the status and size of a response,
+// and the body of a failed one.
+type historyWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+	body   bytes.Buffer
+}
+
+func (hw *historyWriter) WriteHeader(status int) {
+	if hw.status == 0 {
+		hw.status = status
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *historyWriter) Write(p []byte) (int, error) {
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	if hw.status >= http.StatusBadRequest && hw.body.Len() < maxErrorBody {
+		hw.body.Write(p)
+	}
+	n, err := hw.ResponseWriter.Write(p)
+	hw.size += n
+	return n, err
+}
+
+func requestsHandler(h *history) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list := h.list()
+		recs := make([]json.RawMessage, 0, len(list))
+		for _, rec := range list {
+			rec.mu.Lock()
+			bts, err := json.Marshal(rec)
+			rec.mu.Unlock()
+			if err != nil {
+				writeError(w, CodeInternal, err)
+				return
+			}
+			recs = append(recs, bts)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recs)
+	}
+}
+
+// Explanation is the body of a /debug/explain response.
+type Explanation struct {
+	Key    string         `json:"key"`
+	Config *driver.Config `json:"config"`
+	Cached bool           `json:"cached"`
+	// Unverified is true if the entry will be
+	// listed again before it is served.
+	Unverified    bool      `json:"unverified"`
+	WatchDeadline time.Time `json:"watch_deadline"`
+	// LastInvalidation is why and when the entry was last
+	// invalidated. It is absent if it never was.
+	LastInvalidation *cache.Invalidation `json:"last_invalidation,omitempty"`
+}
+
+func explainHandler(dc cache.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Keys are standard base64, whose + an unescaped query
+		// turns into a space, which base64 never holds.
+		key := strings.ReplaceAll(r.URL.Query().Get("key"), " ", "+")
+		if key == "" {
+			writeError(w, CodeBadRequest, fmt.Errorf("key must be set, see the keys of /debug/requests"))
+			return
+		}
+		cfg, err := hash.Parse([]byte(key))
+		if err != nil {
+			writeError(w, CodeBadRequest, err)
+			return
+		}
+		e, err := dc.Explain(cfg)
+		if err != nil {
+			writeError(w, CodeDriverFailure, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Explanation{
+			Key:              key,
+			Config:           cfg,
+			Cached:           e.Cached,
+			Unverified:       e.Unverified,
+			WatchDeadline:    e.WatchDeadline,
+			LastInvalidation: e.LastInvalidation,
+		})
+	}
+}
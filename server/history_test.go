@@ -0,0 +1,35 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"marwan.io/golist/driver"
+	"marwan.io/golist/hash"
+)
+
+func TestRecordSetConfig(t *testing.T) {
+	cfg := &driver.Config{
+		Dir:      "/src/a",
+		Patterns: []string{"./..."},
+		Overlay: map[string][]byte{
+			"/src/a/b.go": []byte("package a"),
+			"/src/a/a.go": []byte("package a"),
+		},
+	}
+	rec := &RequestRecord{}
+	rec.setConfig(cfg)
+	disk := &driver.Config{Dir: cfg.Dir, Patterns: cfg.Patterns}
+	if want := hash.KeyString(disk); rec.Key != want {
+		t.Errorf("Key = %v, want the key of the config without its overlay %v", rec.Key, want)
+	}
+	if rec.Config.Overlay != nil {
+		t.Errorf("Config keeps the overlay contents")
+	}
+	if want := []string{"/src/a/a.go", "/src/a/b.go"}; !reflect.DeepEqual(rec.Overlay, want) {
+		t.Errorf("Overlay = %v, want %v", rec.Overlay, want)
+	}
+	if len(cfg.Overlay) != 2 {
+		t.Errorf("setConfig changed the request's overlay")
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"marwan.io/golist/cache"
+	"marwan.io/golist/crash"
+	"marwan.io/golist/driver"
+	"marwan.io/golist/hash"
+	"marwan.io/golist/logging"
+	"marwan.io/golist/pathutil"
+)
+
+// InvalidateRequest is the body of a /invalidate request.
+// An entry is invalidated if it matches any of the fields.
+type InvalidateRequest struct {
+	// Paths are absolute files or directories. They match the
+	// entries listing packages in or under them, and the
+	// entries of the packages a file belongs or would belong to.
+	Paths []string `json:"paths,omitempty"`
+	// Patterns match the entries listing any of them.
+	Patterns []string `json:"patterns,omitempty"`
+	// Modules are absolute module roots. They match every
+	// entry listed from or listing packages under them.
+	Modules []string `json:"modules,omitempty"`
+	// All matches every entry.
+	All bool `json:"all,omitempty"`
+	// Drop removes the matching entries instead
+	// of refreshing them in the background.
+	Drop bool `json:"drop,omitempty"`
+}
+
+// InvalidateResponse is the body of a successful /invalidate response.
+type InvalidateResponse struct {
+	Matched int  `json:"matched"`
+	Dropped bool `json:"dropped"`
+}
+
+func invalidateHandler(dc cache.Service, lggr *logrus.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, CodeBadRequest, fmt.Errorf("%v is not allowed, use POST", r.Method))
+			return
+		}
+		var req InvalidateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, CodeBadRequest, fmt.Errorf("incorrect request body: %v", err))
+			return
+		}
+		for _, path := range append(req.Paths, req.Modules...) {
+			if !filepath.IsAbs(path) {
+				writeError(w, CodeBadRequest, fmt.Errorf("%v is not an absolute path", path))
+				return
+			}
+		}
+		entries, err := dc.Entries()
+		if err != nil {
+			writeError(w, CodeDriverFailure, err)
+			return
+		}
+		log := logging.From(r.Context(), lggr)
+		matched := map[string]bool{}
+		for _, e := range entries {
+			if !req.matches(e) {
+				continue
+			}
+			log.Infof("invalidating %v", e.Config.Patterns)
+			inv := cache.Invalidation{
+				Reason:    cache.Invalidated,
+				Time:      time.Now(),
+				RequestID: logging.ID(r.Context()),
+			}
+			// Don't trust go list runs that started before now.
+			dc.Changed(e.Config, inv)
+			if req.Drop {
+				err = dc.Delete(e.Config)
+			} else {
+				// Until the refresh is done, Gets list the entry again.
+				err = dc.MarkUnverified(e.Config, inv)
+			}
+			if err != nil {
+				writeError(w, CodeDriverFailure, err)
+				return
+			}
+			matched[hash.KeyString(e.Config)] = true
+		}
+		if !req.Drop && len(matched) > 0 {
+			// The refresh outlives the request, but keeps its ID.
+			ctx := logging.WithID(context.Background(), logging.ID(r.Context()))
+			go func() {
+				defer crash.Recover(lggr, "refreshing invalidated entries", nil)
+				err := dc.UpdateMatching(ctx, func(cfg *driver.Config) bool {
+					return matched[hash.KeyString(cfg)]
+				})
+				if err != nil {
+					log.Errorf("could not refresh invalidated entries: %v", err)
+				}
+			}()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(InvalidateResponse{Matched: len(matched), Dropped: req.Drop})
+	}
+}
+
+func (req *InvalidateRequest) matches(e cache.Entry) bool {
+	if req.All {
+		return true
+	}
+	for _, p := range req.Patterns {
+		for _, pattern := range e.Config.Patterns {
+			if p == pattern {
+				return true
+			}
+		}
+	}
+	dirs := e.Dirs
+	for _, pattern := range e.Config.Patterns {
+		if strings.HasPrefix(pattern, "file=") {
+			dirs = append(dirs, filepath.Dir(pattern[len("file="):]))
+		}
+	}
+	for _, root := range req.Modules {
+		if pathutil.Within(root, e.Config.Dir) || anyWithin(root, dirs) {
+			return true
+		}
+	}
+	for _, path := range req.Paths {
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			if anyWithin(path, dirs) {
+				return true
+			}
+			continue
+		}
+		// A file, possibly deleted or not written yet,
+		// belongs to the package of its directory.
+		for _, dir := range dirs {
+			if dir == filepath.Dir(path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func anyWithin(root string, paths []string) bool {
+	for _, path := range paths {
+		if pathutil.Within(root, path) {
+			return true
+		}
+	}
+	return false
+}
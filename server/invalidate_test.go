@@ -0,0 +1,68 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"marwan.io/golist/cache"
+	"marwan.io/golist/driver"
+)
+
+func TestInvalidateMatches(t *testing.T) {
+	root := t.TempDir()
+	pkg := filepath.Join(root, "pkg")
+	if err := os.MkdirAll(filepath.Join(pkg, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(t.TempDir(), "other")
+	entry := cache.Entry{
+		Config: &driver.Config{Dir: root, Patterns: []string{"./pkg/..."}},
+		Dirs:   []string{pkg, filepath.Join(pkg, "sub")},
+	}
+	fileEntry := cache.Entry{
+		Config: &driver.Config{Dir: other, Patterns: []string{"file=" + filepath.Join(pkg, "a.go")}},
+	}
+	for _, tc := range []struct {
+		name  string
+		req   InvalidateRequest
+		entry cache.Entry
+		want  bool
+	}{
+		{name: "all", req: InvalidateRequest{All: true}, entry: entry, want: true},
+		{name: "empty", entry: entry, want: false},
+		{name: "pattern", req: InvalidateRequest{Patterns: []string{"./pkg/..."}}, entry: entry, want: true},
+		{name: "other pattern", req: InvalidateRequest{Patterns: []string{"./..."}}, entry: entry, want: false},
+		{name: "module of the dir", req: InvalidateRequest{Modules: []string{root}}, entry: entry, want: true},
+		{name: "module of a package", req: InvalidateRequest{Modules: []string{pkg}}, entry: entry, want: true},
+		{name: "other module", req: InvalidateRequest{Modules: []string{other}}, entry: entry, want: false},
+		{name: "dir above the packages", req: InvalidateRequest{Paths: []string{root}}, entry: entry, want: true},
+		{name: "dir of a package", req: InvalidateRequest{Paths: []string{filepath.Join(pkg, "sub")}}, entry: entry, want: true},
+		{name: "file of a package", req: InvalidateRequest{Paths: []string{filepath.Join(pkg, "new.go")}}, entry: entry, want: true},
+		{name: "file below a package", req: InvalidateRequest{Paths: []string{filepath.Join(pkg, "x", "a.go")}}, entry: entry, want: false},
+		{name: "file= pattern dir", req: InvalidateRequest{Paths: []string{filepath.Join(pkg, "b.go")}}, entry: fileEntry, want: true},
+		{name: "file= pattern module", req: InvalidateRequest{Modules: []string{pkg}}, entry: fileEntry, want: true},
+	} {
+		if got := tc.req.matches(tc.entry); got != tc.want {
+			t.Errorf("%v: matches() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAnyWithin(t *testing.T) {
+	for _, tc := range []struct {
+		root  string
+		paths []string
+		want  bool
+	}{
+		{root: "/a", paths: nil, want: false},
+		{root: "/a", paths: []string{"/b", "/a"}, want: true},
+		{root: "/a", paths: []string{"/a/b/c"}, want: true},
+		{root: "/a", paths: []string{"/ab", "/"}, want: false},
+		{root: "/a", paths: []string{"/a/../b"}, want: false},
+	} {
+		if got := anyWithin(tc.root, tc.paths); got != tc.want {
+			t.Errorf("anyWithin(%q, %q) = %v, want %v", tc.root, tc.paths, got, tc.want)
+		}
+	}
+}
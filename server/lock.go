@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrAlreadyRunning is returned by RunServer when another
+// server already holds the lock of the cache directory.
+var ErrAlreadyRunning = errors.New("a golist server is already running")
+
+// GetLockPath returns the path of the file that makes sure only
+// one server runs per user and cache database at a time.
+func GetLockPath() string {
+	return GetDBPath() + ".lock"
+}
+
+// lockWait is how long a starting server waits for the lock,
+// which lets a server that is shutting down finish cleanly
+// when a client restarts it.
+const lockWait = 3 * time.Second
+
+// lock acquires the server lock and records the server's pid in it.
+// The lock is released by the OS if the server dies, so a crashed
+// server never keeps the next one from starting.
+func lock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = flock(f)
+	for deadline := time.Now().Add(lockWait); err != nil && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		err = flock(f)
+	}
+	if err != nil {
+		f.Close()
+		if pid, ok := readPID(path); ok {
+			return nil, fmt.Errorf("%w (pid %d)", ErrAlreadyRunning, pid)
+		}
+		return nil, ErrAlreadyRunning
+	}
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	return f, nil
+}
+
+// unlock releases the lock. The file itself is left in place: removing
+// it would let a starting server lock a different file than one that
+// opened it just before the removal.
+func unlock(f *os.File) {
+	f.Close()
+}
+
+func readPID(path string) (int, bool) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bts)))
+	return pid, err == nil
+}
+
+// removeStaleSocket removes the socket left behind by a server that
+// crashed. It must only be called while holding the server lock.
+// A socket that still accepts connections belongs to a server that
+// does not use the lock, such as an older golist, and is left alone.
+func removeStaleSocket(socket string) error {
+	if _, err := os.Stat(socket); os.IsNotExist(err) {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%w: %v is accepting connections", ErrAlreadyRunning, socket)
+	}
+	return os.Remove(socket)
+}
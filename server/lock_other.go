@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd
+
+package server
+
+import "os"
+
+// flock is a no-op where advisory locks are not available;
+// bolt's own file lock still keeps a second server out.
+func flock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockRecordsPID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.lock")
+	if err := ioutil.WriteFile(path, []byte("123456789\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := lock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock(f)
+	if pid, ok := readPID(path); !ok || pid != os.Getpid() {
+		t.Fatalf("readPID() = %v, %v, want %v", pid, ok, os.Getpid())
+	}
+}
+
+func TestReadPID(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    int
+		ok      bool
+	}{
+		{name: "pid", content: "42\n", want: 42, ok: true},
+		{name: "empty", content: "", ok: false},
+		{name: "garbage", content: "pid 42\n", ok: false},
+	} {
+		path := filepath.Join(dir, tc.name)
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if pid, ok := readPID(path); pid != tc.want || ok != tc.ok {
+			t.Errorf("%v: readPID() = %v, %v, want %v, %v", tc.name, pid, ok, tc.want, tc.ok)
+		}
+	}
+	if _, ok := readPID(filepath.Join(dir, "missing")); ok {
+		t.Error("readPID() of a missing file succeeded")
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("missing", func(t *testing.T) {
+		if err := removeStaleSocket(filepath.Join(dir, "missing.sock")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		socket := filepath.Join(dir, "stale.sock")
+		ln, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Skip(err)
+		}
+		// Keep the file, as a crashed server does.
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		ln.Close()
+		if err := removeStaleSocket(socket); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(socket); !os.IsNotExist(err) {
+			t.Fatalf("%v was not removed", socket)
+		}
+	})
+
+	t.Run("accepting", func(t *testing.T) {
+		socket := filepath.Join(dir, "live.sock")
+		ln, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Skip(err)
+		}
+		defer ln.Close()
+		if err := removeStaleSocket(socket); !errors.Is(err, ErrAlreadyRunning) {
+			t.Fatalf("removeStaleSocket() = %v, want %v", err, ErrAlreadyRunning)
+		}
+		if _, err := os.Stat(socket); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
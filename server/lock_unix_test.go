@@ -0,0 +1,35 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd
+// +build linux darwin freebsd openbsd netbsd
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLockHeld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.lock")
+	f, err := lock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second lock waits lockWait before giving up.
+	_, err = lock(path)
+	if !errors.Is(err, ErrAlreadyRunning) {
+		t.Fatalf("lock() = %v, want %v", err, ErrAlreadyRunning)
+	}
+	if want := fmt.Sprintf("(pid %d)", os.Getpid()); !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("lock() = %v, want the pid of the holder", err)
+	}
+	unlock(f)
+	f, err = lock(path)
+	if err != nil {
+		t.Fatalf("lock() after unlock = %v", err)
+	}
+	unlock(f)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+
+	"marwan.io/golist/cache"
+	"marwan.io/golist/driver"
+	"marwan.io/golist/metrics"
+	"marwan.io/golist/sched"
+	"marwan.io/golist/watcher"
+)
+
+var (
+	requests        = metrics.NewCounter("golist_requests_total", "Driver requests by load mode and outcome.", "mode", "outcome")
+	requestDuration = metrics.NewHistogram("golist_request_duration_seconds", "Duration of driver requests.", metrics.DurationBuckets)
+)
+
+var modeNames = map[driver.LoadMode]string{
+	driver.LoadFiles:     "files",
+	driver.LoadImports:   "imports",
+	driver.LoadTypes:     "types",
+	driver.LoadSyntax:    "syntax",
+	driver.LoadAllSyntax: "all_syntax",
+}
+
+// recorder collects what the timer middleware
+// reports about a request.
+type recorder struct {
+	http.ResponseWriter
+	mode    string
+	outcome string
+}
+
+// setMode records the load mode of a request
+// whose writer was wrapped by the timer middleware.
+func setMode(w http.ResponseWriter, mode driver.LoadMode) {
+	if rec, ok := w.(*recorder); ok {
+		rec.mode = modeNames[mode]
+		if rec.mode == "" {
+			rec.mode = "unknown"
+		}
+	}
+}
+
+func setOutcome(w http.ResponseWriter, code ErrorCode) {
+	if rec, ok := w.(*recorder); ok {
+		rec.outcome = string(code)
+	}
+}
+
+// registerGauges exports the state of the cache and the watchers.
+func registerGauges(dc cache.Service, ws watcher.Service, sc *sched.Scheduler) {
+	stat := func(fn func(st cache.Stats) float64) func() float64 {
+		return func() float64 {
+			st, _ := dc.Stats()
+			return fn(st)
+		}
+	}
+	metrics.NewGaugeFunc("golist_db_size_bytes", "Size of the cache database.", stat(func(st cache.Stats) float64 {
+		return float64(st.Size)
+	}))
+	metrics.NewGaugeFunc("golist_cache_entries", "Number of cached driver responses.", stat(func(st cache.Stats) float64 {
+		return float64(st.Entries)
+	}))
+	metrics.NewGaugeFunc("golist_go_list_runs", "Number of go list runs in flight.", stat(func(st cache.Stats) float64 {
+		return float64(len(st.Runs))
+	}))
+	metrics.NewGaugeFunc("golist_go_processes", "Number of go commands running.", func() float64 {
+		return float64(sc.Stats().Running)
+	})
+	for _, p := range []sched.Priority{sched.Interactive, sched.Background} {
+		p := p
+		metrics.NewGaugeFunc("golist_queue_depth_"+p.String(), "Number of go commands waiting in the "+p.String()+" lane.", func() float64 {
+			return float64(sc.Stats().Queued[p])
+		})
+	}
+	metrics.NewGaugeFunc("golist_watchers", "Number of active watchers.", func() float64 {
+		return float64(len(ws.Status()))
+	})
+	metrics.NewGaugeFunc("golist_watchers_polling", "Number of active watchers that poll.", func() float64 {
+		var n int
+		for _, s := range ws.Status() {
+			if s.Polling {
+				n++
+			}
+		}
+		return float64(n)
+	})
+}
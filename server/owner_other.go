@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd
+
+package server
+
+import "os"
+
+func ownedByUser(fi os.FileInfo) bool {
+	return true
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// GetSocketPath is the path of a unix socket for
+// client/server communication, as configured.
+func GetSocketPath() string {
+	return loadedConfig().Socket
+}
+
+// GetDBPath returns the path to the cache database, as configured.
+func GetDBPath() string {
+	return loadedConfig().DB
+}
+
+// GetLogPath returns the path of the server's log file, as configured.
+func GetLogPath() string {
+	return loadedConfig().LogFile
+}
+
+// defaultSocketPath is private to the current user:
+// it lives in $XDG_RUNTIME_DIR when set, and in a
+// per-user directory of the temp dir otherwise.
+func defaultSocketPath() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "golist", "golist.sock"), nil
+	}
+	dir, err := userTempDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "golist.sock"), nil
+}
+
+// defaultDBPath is in the user's cache
+// directory ($XDG_CACHE_HOME on Linux).
+func defaultDBPath() (string, error) {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "golist", "golist.db"), nil
+	}
+	dir, err := userTempDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "golist.db"), nil
+}
+
+// defaultLogPath is next to the default database db.
+func defaultLogPath(db string) string {
+	return filepath.Join(filepath.Dir(db), "golist.log")
+}
+
+func userTempDir() (string, error) {
+	tempdir := os.TempDir()
+	if tempdir == "" {
+		return "", errors.New("no temp dir provided by os")
+	}
+	return filepath.Join(tempdir, "golist-"+strconv.Itoa(os.Getuid())), nil
+}
+
+// SecureDir creates dir, if needed, so that only the current user
+// can use it, and fails if an existing dir is owned by someone else
+// or accessible to others. Otherwise another user on a shared host
+// could answer or block our queries.
+func SecureDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%v is not a directory", dir)
+	}
+	if !ownedByUser(fi) {
+		return fmt.Errorf("%v is not owned by the current user", dir)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%v must not be accessible by other users (mode %v)", dir, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// PrepareSocketDir makes sure the directory of the socket exists and,
+// unless it was configured, is private to the user.
+func PrepareSocketDir() error {
+	return prepareDir(GetSocketPath(), defaultSocketPath)
+}
+
+// prepareDir prepares the directory of path. Directories picked by
+// golist, where path is the default, must be private to the user;
+// configured ones are the user's responsibility and are only created
+// if missing.
+func prepareDir(path string, def func() (string, error)) error {
+	dir := filepath.Dir(path)
+	if p, err := def(); err != nil || path != p {
+		return os.MkdirAll(dir, 0700)
+	}
+	return SecureDir(dir)
+}
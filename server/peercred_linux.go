@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// userOnly wraps l so that connections from other users are
+// dropped, as a second line of defense after the socket's
+// file permissions.
+func userOnly(l net.Listener, lggr *logrus.Logger) net.Listener {
+	return &peerCredListener{Listener: l, lggr: lggr}
+}
+
+type peerCredListener struct {
+	net.Listener
+	lggr *logrus.Logger
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := peerUID(conn)
+		if err == nil && uid == os.Getuid() {
+			return conn, nil
+		}
+		l.lggr.Warnf("rejecting connection from uid %d: %v", uid, err)
+		conn.Close()
+	}
+}
+
+func peerUID(conn net.Conn) (int, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return -1, nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return -1, err
+	}
+	if credErr != nil {
+		return -1, credErr
+	}
+	return int(cred.Uid), nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"marwan.io/golist/driver"
+)
+
+// Request is the JSON body of a request to the / endpoint. It mirrors
+// the request go/packages sends to a driver, plus the patterns and
+// the directory to list them from. The response is the JSON driver
+// response of go/packages, or an Error.
+type Request struct {
+	// Version is the protocol version the request was written for.
+	// Zero means ProtocolVersion.
+	Version    int               `json:"version,omitempty"`
+	Patterns   []string          `json:"patterns"`
+	Mode       driver.LoadMode   `json:"mode"`
+	Env        []string          `json:"env"`
+	BuildFlags []string          `json:"build_flags"`
+	Tests      bool              `json:"tests"`
+	Overlay    map[string][]byte `json:"overlay,omitempty"`
+	// Dir is the absolute directory go list runs in.
+	Dir string `json:"dir"`
+}
+
+// NewRequest returns the request for cfg.
+func NewRequest(cfg *driver.Config) *Request {
+	return &Request{
+		Version:    ProtocolVersion,
+		Patterns:   cfg.Patterns,
+		Mode:       cfg.Mode,
+		Env:        cfg.Env,
+		BuildFlags: cfg.BuildFlags,
+		Tests:      cfg.Tests,
+		Overlay:    cfg.Overlay,
+		Dir:        cfg.Dir,
+	}
+}
+
+// Config returns the driver config of r.
+func (r *Request) Config() *driver.Config {
+	return &driver.Config{
+		Mode:       r.Mode,
+		Patterns:   r.Patterns,
+		Dir:        r.Dir,
+		Env:        r.Env,
+		BuildFlags: r.BuildFlags,
+		Tests:      r.Tests,
+		Overlay:    r.Overlay,
+	}
+}
+
+// gobContentType marks a request body as a gob of driver.Config.
+const gobContentType = "application/x-gob"
+
+// decodeRequest reads the driver config of r. JSON bodies are the
+// protocol. A body without a content type, or marked as a gob, is
+// decoded as a gob of driver.Config, which is what clients before
+// the JSON protocol sent. The gob path is deprecated.
+func decodeRequest(r *http.Request, lggr logrus.FieldLogger) (*driver.Config, *Error) {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch ct {
+	case "application/json":
+	case "", gobContentType:
+		lggr.Warnf("received a deprecated gob request, send JSON instead")
+		var cfg driver.Config
+		if err := gob.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			return nil, &Error{Code: CodeBadRequest, Message: fmt.Sprintf("incorrect request body: %v", err)}
+		}
+		if msg, ok := validDir(cfg.Dir); !ok {
+			return nil, &Error{Code: CodeBadRequest, Message: msg}
+		}
+		return &cfg, nil
+	default:
+		return nil, &Error{
+			Code:    CodeBadRequest,
+			Message: fmt.Sprintf("unsupported content type %q, requests need Content-Type: application/json", r.Header.Get("Content-Type")),
+		}
+	}
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, &Error{Code: CodeBadRequest, Message: fmt.Sprintf("incorrect request body: %v", err)}
+	}
+	if req.Version != 0 && req.Version != ProtocolVersion {
+		return nil, &Error{
+			Code:    CodeVersionMismatch,
+			Message: fmt.Sprintf("request version %v is not supported, the server speaks %v", req.Version, ProtocolVersion),
+		}
+	}
+	if msg, ok := validDir(req.Dir); !ok {
+		return nil, &Error{Code: CodeBadRequest, Message: msg}
+	}
+	return req.Config(), nil
+}
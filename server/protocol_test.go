@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"marwan.io/golist/driver"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing")
+	jsonBody := func(req Request) []byte {
+		bts, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bts
+	}
+	gobBody := func(cfg driver.Config) []byte {
+		var b bytes.Buffer
+		if err := gob.NewEncoder(&b).Encode(cfg); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	want := &driver.Config{Mode: driver.LoadImports, Patterns: []string{"./..."}, Dir: dir}
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        []byte
+		wantCode    ErrorCode
+	}{
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        jsonBody(Request{Version: ProtocolVersion, Mode: want.Mode, Patterns: want.Patterns, Dir: dir}),
+		},
+		{
+			name:        "json with charset and default version",
+			contentType: "application/json; charset=utf-8",
+			body:        jsonBody(Request{Mode: want.Mode, Patterns: want.Patterns, Dir: dir}),
+		},
+		{
+			name:        "other version",
+			contentType: "application/json",
+			body:        jsonBody(Request{Version: ProtocolVersion + 1, Patterns: want.Patterns, Dir: dir}),
+			wantCode:    CodeVersionMismatch,
+		},
+		{
+			name:        "json missing dir",
+			contentType: "application/json",
+			body:        jsonBody(Request{Patterns: want.Patterns, Dir: missing}),
+			wantCode:    CodeBadRequest,
+		},
+		{
+			name:        "malformed json",
+			contentType: "application/json",
+			body:        []byte("{"),
+			wantCode:    CodeBadRequest,
+		},
+		{
+			name: "gob without content type",
+			body: gobBody(*want),
+		},
+		{
+			name:        "gob",
+			contentType: gobContentType,
+			body:        gobBody(*want),
+		},
+		{
+			name:     "gob missing dir",
+			body:     gobBody(driver.Config{Patterns: want.Patterns, Dir: missing}),
+			wantCode: CodeBadRequest,
+		},
+		{
+			name:        "other content type",
+			contentType: "text/plain",
+			body:        jsonBody(Request{Mode: want.Mode, Patterns: want.Patterns, Dir: dir}),
+			wantCode:    CodeBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", bytes.NewReader(tc.body))
+			if tc.contentType != "" {
+				r.Header.Set("Content-Type", tc.contentType)
+			}
+			lggr := logrus.New()
+			lggr.SetOutput(ioutil.Discard)
+			cfg, e := decodeRequest(r, lggr)
+			if tc.wantCode != "" {
+				if e == nil || e.Code != tc.wantCode {
+					t.Fatalf("decodeRequest() error = %v, want code %v", e, tc.wantCode)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatal(e)
+			}
+			if !reflect.DeepEqual(cfg, want) {
+				t.Fatalf("decodeRequest() = %+v, want %+v", cfg, want)
+			}
+		})
+	}
+}
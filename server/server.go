@@ -2,104 +2,322 @@ package server
 
 import (
 	"context"
-	"encoding/gob"
+	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"marwan.io/golist/cache"
-	"marwan.io/golist/driver"
+	"marwan.io/golist/crash"
+	"marwan.io/golist/events"
+	"marwan.io/golist/logging"
+	"marwan.io/golist/metrics"
+	"marwan.io/golist/sched"
 	"marwan.io/golist/watcher"
 )
 
-// RunServer runs the golist caching server on a unix socket.
-func RunServer(verbose bool) error {
-	lggr := logrus.New()
-	level := logrus.WarnLevel
-	if verbose {
-		level = logrus.DebugLevel
+// Options are the command line overrides of the Config read
+// from the configuration file and env. Zero values leave the
+// configured setting alone.
+type Options struct {
+	// Verbose turns on debug logging.
+	Verbose bool
+	// Poll makes the watcher poll files instead of
+	// using native file system notifications.
+	Poll bool
+	// PollInterval is how often polled files are checked.
+	PollInterval time.Duration
+	// WatchExpiry is how long an entry is watched after its
+	// last request before it is marked unverified.
+	WatchExpiry time.Duration
+	// Ignore lists extra gitignore style patterns
+	// of files the watcher should not react to.
+	Ignore []string
+	// DrainTimeout bounds how long a shutting down server waits
+	// for requests and go list runs in flight.
+	DrainTimeout time.Duration
+	// IdleTimeout makes the server exit after a period without
+	// requests. Zero means the server runs until it is stopped.
+	IdleTimeout time.Duration
+	// MaxProcs is the most go commands the server runs at once.
+	MaxProcs int
+	// MaxQueue is the most client requests that may wait for a
+	// go command before the server answers that it is busy.
+	MaxQueue int
+	// GoTimeout is how long a single go command may run
+	// before it and the processes it started are killed.
+	GoTimeout time.Duration
+}
+
+// apply overrides the settings of cfg that opts sets.
+func (opts Options) apply(cfg *Config) {
+	if opts.Verbose {
+		cfg.LogLevel = "debug"
 	}
-	lggr.SetLevel(level)
-	dbPath := GetDBPath()
+	if opts.Poll {
+		cfg.Poll = true
+	}
+	if opts.PollInterval > 0 {
+		cfg.PollInterval = Duration(opts.PollInterval)
+	}
+	if opts.WatchExpiry > 0 {
+		cfg.WatchExpiry = Duration(opts.WatchExpiry)
+	}
+	cfg.Ignore = append(cfg.Ignore, opts.Ignore...)
+	if opts.DrainTimeout > 0 {
+		cfg.DrainTimeout = Duration(opts.DrainTimeout)
+	}
+	if opts.IdleTimeout > 0 {
+		cfg.IdleTimeout = Duration(opts.IdleTimeout)
+	}
+	if opts.MaxProcs > 0 {
+		cfg.MaxProcs = opts.MaxProcs
+	}
+	if opts.MaxQueue > 0 {
+		cfg.MaxQueue = opts.MaxQueue
+	}
+	if opts.GoTimeout > 0 {
+		cfg.GoTimeout = Duration(opts.GoTimeout)
+	}
+}
+
+const defaultDrainTimeout = 10 * time.Second
+
+// RunServer runs the golist caching server on a unix socket,
+// configured by LoadConfig and then opts.
+func RunServer(opts Options) error {
+	// Identify the binary now, before it can be reinstalled
+	// under us, rather than on the first request.
+	BuildID()
+	cfg, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("could not load config: %v", err)
+	}
+	opts.apply(&cfg)
+	lggr, closeLog, err := newLogger(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	st := &state{started: time.Now()}
+	socket, dbPath := cfg.Socket, cfg.DB
+	if err := prepareDir(socket, defaultSocketPath); err != nil {
+		return err
+	}
+	if err := prepareDir(dbPath, defaultDBPath); err != nil {
+		return err
+	}
+	lf, err := lock(GetLockPath())
+	if err != nil {
+		return err
+	}
+	defer unlock(lf)
 	lggr.Debugf("db path at %v", dbPath)
-	dc, err := cache.New(dbPath, lggr)
+	bus := events.NewBus()
+	sc := sched.New(cfg.MaxProcs, cfg.MaxQueue)
+	dc, err := cache.New(dbPath, lggr, cache.Options{
+		Events:     bus,
+		Scheduler:  sc,
+		GoTimeout:  time.Duration(cfg.GoTimeout),
+		MaxEntries: cfg.MaxEntries,
+	})
 	if err != nil {
 		return err
 	}
-	go dc.UpdateAll(context.Background())
-	w := watcher.NewService(dc, lggr)
-	ch := make(chan os.Signal, 2) // len == 2: one for ctrl+C and one for /exit
-	http.HandleFunc("/", timer(handler(dc, w, lggr), lggr))
+	st.socket = socket
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cfg.UpdateOnStart {
+		go st.updateAll(ctx, dc, lggr)
+	}
+	w := watcher.NewService(dc, lggr, watcher.Options{
+		Poll:           cfg.Poll,
+		PollInterval:   time.Duration(cfg.PollInterval),
+		Expiry:         time.Duration(cfg.WatchExpiry),
+		RefreshTimeout: time.Duration(cfg.RefreshTimeout),
+		Ignore:         cfg.Ignore,
+		Events:         bus,
+	})
+	if err := w.Restore(); err != nil {
+		lggr.Errorf("could not restore watchers: %v", err)
+	}
+	ch := make(chan os.Signal, 3) // len == 3: one for a signal, one for /exit and one for idling
+	hist := newHistory(cfg.HistorySize)
+	http.HandleFunc("/", st.track(withRequestID(hist.record(timer(checkVersion(handler(dc, w, lggr)), lggr)))))
 	http.HandleFunc("/exit", exitHandler(ch))
+	http.HandleFunc("/version", versionHandler)
+	http.HandleFunc("/status", statusHandler(st, dc, w, sc))
+	http.HandleFunc("/metrics", metrics.Default.Handler())
+	http.HandleFunc("/invalidate", st.track(withRequestID(invalidateHandler(dc, lggr))))
+	// Event streams stay open, so they don't count as activity.
+	http.HandleFunc("/events", eventsHandler(bus))
+	http.HandleFunc("/debug/requests", requestsHandler(hist))
+	http.HandleFunc("/debug/explain", explainHandler(dc))
+	registerGauges(dc, w, sc)
 
-	socket := GetSocketPath()
+	if err := removeStaleSocket(socket); err != nil {
+		return err
+	}
 	l, err := net.Listen("unix", socket)
 	if err != nil {
 		return err
 	}
-	s := &http.Server{Handler: http.DefaultServeMux}
-	signal.Notify(ch, os.Interrupt)
+	if err := os.Chmod(socket, 0600); err != nil {
+		return err
+	}
+	l = userOnly(l, lggr)
+	s := &http.Server{Handler: recoverer(http.DefaultServeMux, lggr)}
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		lggr.Debugf("listening on unix socket: %v", socket)
 		go s.Serve(l)
 	}()
+	if cfg.IdleTimeout > 0 {
+		go st.exitWhenIdle(time.Duration(cfg.IdleTimeout), ch, lggr)
+	}
 
-	<-ch
-	lggr.Info("SHUTTING DOWN SERVER...")
-	err = s.Shutdown(context.Background())
+	sig := <-ch
+	lggr.Infof("SHUTTING DOWN SERVER (%v)...", sig)
+	drainTimeout := time.Duration(cfg.DrainTimeout)
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer drainCancel()
+	// End the event streams, or Shutdown would wait for them.
+	bus.Close()
+	err = s.Shutdown(drainCtx)
 	if err != nil && err != http.ErrServerClosed {
-		lggr.Error(err)
+		lggr.Errorf("could not drain requests: %v", err)
+		s.Close()
 	}
 	os.RemoveAll(socket)
 	lggr.Info("closing watchers")
-	return w.Close()
+	if err := w.Close(); err != nil {
+		lggr.Errorf("could not close watchers: %v", err)
+	}
+	if err := dc.Drain(drainCtx); err != nil {
+		lggr.Warnf("go list runs still in flight after %v, cancelled them", drainTimeout)
+	}
+	cancel()
+	lggr.Info("closing db")
+	return dc.Close()
 }
 
-func timer(h http.HandlerFunc, lggr *logrus.Logger) http.HandlerFunc {
+// newLogger returns the server's logger, which writes text to stderr
+// and, unless cfg.LogFile is empty, JSON to the rotated log file.
+// Each output has its own level. The returned func closes the file.
+func newLogger(cfg Config) (*logrus.Logger, func(), error) {
+	level, err := logrus.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad log level: %v", err)
+	}
+	lggr := logrus.New()
+	// The hooks do the writing.
+	lggr.SetOutput(ioutil.Discard)
+	lggr.SetLevel(level)
+	lggr.AddHook(logging.NewHook(os.Stderr, &logrus.TextFormatter{}, level))
+	if cfg.LogFile == "" {
+		return lggr, func() {}, nil
+	}
+	fileLevel, err := logrus.ParseLevel(cfg.LogFileLevel)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad log file level: %v", err)
+	}
+	if fileLevel > level {
+		lggr.SetLevel(fileLevel)
+	}
+	f, err := logging.OpenFile(cfg.LogFile, int64(cfg.LogMaxSize)<<20, cfg.LogBackups)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open log file: %v", err)
+	}
+	lggr.AddHook(logging.NewHook(f, &logrus.JSONFormatter{}, fileLevel))
+	return lggr, func() { f.Close() }, nil
+}
+
+// withRequestID gives every request an ID, which is sent back
+// to the client and logged with everything done for the request.
+func withRequestID(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		t := time.Now()
-		h(w, r)
-		lggr.Info(time.Since(t))
+		id := logging.NewID()
+		w.Header().Set(RequestIDHeader, id)
+		h(w, r.WithContext(logging.WithID(r.Context(), id)))
 	}
 }
 
-// Body is the golist body request
-//
-// TODO: add no-cache flag so that when error occurs, try it.
-type Body struct {
-	Args []string `json:"args"`
-	Dir  string   `json:"dir"`
+// recoverer turns a panicking request into an error
+// response instead of a dropped connection.
+func recoverer(h http.Handler, lggr *logrus.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer crash.Recover(lggr, "serving "+r.URL.Path, func(err error) {
+			writeError(w, CodeInternal, err)
+		})
+		h.ServeHTTP(w, r)
+	})
+}
+
+func timer(h http.HandlerFunc, lggr *logrus.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now()
+		rec := &recorder{ResponseWriter: w, mode: "unknown", outcome: "ok"}
+		h(rec, r)
+		d := time.Since(t)
+		logging.From(r.Context(), lggr).Infof("%v %v took %v", rec.mode, rec.outcome, d)
+		requests.Inc(rec.mode, rec.outcome)
+		requestDuration.Observe(d.Seconds())
+	}
 }
 
 func handler(dc cache.Service, ws watcher.Service, lggr *logrus.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var cfg driver.Config
-		err := gob.NewDecoder(r.Body).Decode(&cfg)
-		if err != nil {
-			lggr.Warnf("incorrect request body: %v", err)
-			w.WriteHeader(400)
+		lggr := logging.From(r.Context(), lggr)
+		cfg, e := decodeRequest(r, lggr)
+		if e != nil {
+			lggr.Warnf("%v", e.Message)
+			e.write(w)
 			return
 		}
+		setMode(w, cfg.Mode)
+		requestRecord(r.Context()).setConfig(cfg)
 		lggr.Debugf("received %v - mode: %v, test: %v", cfg.Patterns, cfg.Mode, cfg.Tests)
 		// TODO: check if valid files
-		bts, err := dc.Get(r.Context(), &cfg)
+		// A client is waiting: go before background refreshes.
+		ctx := sched.WithPriority(r.Context(), sched.Interactive)
+		bts, err := dc.Get(ctx, cfg)
 		if err != nil {
-			fmt.Fprint(w, err.Error())
+			lggr.Errorf("%v: %v", cfg.Patterns, err)
+			code := CodeDriverFailure
+			switch {
+			case r.Context().Err() != nil:
+				code = CodeTimeout
+			case errors.Is(err, sched.ErrBusy):
+				code = CodeOverloaded
+			}
+			writeError(w, code, err)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
 		w.Write(bts)
-		ws.Watch(&cfg)
+		if len(cfg.Overlay) == 0 {
+			ws.Watch(r.Context(), cfg)
+		}
 	}
 }
 
 func exitHandler(ch chan os.Signal) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("outdated") != "" && r.Header.Get(BuildIDHeader) == BuildID() {
+			// Another client already restarted us.
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprintln(w, os.Getpid())
 		go func() {
 			time.Sleep(time.Millisecond * 200)
 			ch <- os.Interrupt
@@ -107,25 +325,6 @@ func exitHandler(ch chan os.Signal) http.HandlerFunc {
 	}
 }
 
-// GetSocketPath is the path of a unix socket for
-// client/server communication.
-func GetSocketPath() string {
-	tempdir := os.TempDir()
-	if tempdir == "" {
-		log.Fatal("no temp dir provided by os")
-	}
-	return filepath.Join(tempdir, "golistsocket")
-}
-
-// GetDBPath returns the path to the cache database.
-func GetDBPath() string {
-	tempdir := os.TempDir()
-	if tempdir == "" {
-		log.Fatal("no temp dir provided by os")
-	}
-	return filepath.Join(tempdir, "golist.db")
-}
-
 func validDir(dir string) (string, bool) {
 	if dir == "" {
 		return "dir must not be empty", false
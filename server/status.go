@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"marwan.io/golist/cache"
+	"marwan.io/golist/crash"
+	"marwan.io/golist/sched"
+	"marwan.io/golist/watcher"
+)
+
+// Status is the body of a /status response.
+type Status struct {
+	PID     int       `json:"pid"`
+	Version Version   `json:"version"`
+	Started time.Time `json:"started"`
+	Uptime  string    `json:"uptime"`
+	Socket  string    `json:"socket"`
+	DBPath  string    `json:"db_path"`
+	DBSize  int64     `json:"db_size"`
+	Entries int       `json:"entries"`
+	// Crashes counts the panics recovered since the server started.
+	Crashes int64 `json:"crashes"`
+	// UpdatingAll is true while the startup
+	// revalidation of every entry is running.
+	UpdatingAll bool            `json:"updating_all"`
+	Watchers    []WatcherStatus `json:"watchers"`
+	Runs        []RunStatus     `json:"runs"`
+	Scheduler   SchedulerStatus `json:"scheduler"`
+}
+
+// SchedulerStatus describes the go commands
+// running and waiting to run.
+type SchedulerStatus struct {
+	MaxProcs int `json:"max_procs"`
+	Running  int `json:"running"`
+	// Queued is the number of waiting go commands by lane,
+	// "interactive" or "background".
+	Queued map[string]int `json:"queued"`
+}
+
+func schedulerStatus(sc *sched.Scheduler) SchedulerStatus {
+	st := sc.Stats()
+	status := SchedulerStatus{MaxProcs: st.Max, Running: st.Running, Queued: map[string]int{}}
+	for p, n := range st.Queued {
+		status.Queued[p.String()] = n
+	}
+	return status
+}
+
+// WatcherStatus describes an active watcher.
+type WatcherStatus struct {
+	Patterns []string  `json:"patterns"`
+	Dir      string    `json:"dir"`
+	Expires  time.Time `json:"expires"`
+	Polling  bool      `json:"polling"`
+}
+
+// RunStatus describes a go list run in flight.
+type RunStatus struct {
+	Patterns []string  `json:"patterns"`
+	Dir      string    `json:"dir"`
+	Started  time.Time `json:"started"`
+	Elapsed  string    `json:"elapsed"`
+}
+
+// state is what the server knows about itself
+// on top of what the cache and the watchers report.
+type state struct {
+	started  time.Time
+	socket   string
+	updating int32
+	// active counts the requests in flight and
+	// lastActive is when the last one ended, in
+	// Unix nanoseconds.
+	active     int32
+	lastActive int64
+}
+
+// updateAll runs the startup revalidation of the cache.
+func (st *state) updateAll(ctx context.Context, dc cache.Service, lggr *logrus.Logger) {
+	atomic.StoreInt32(&st.updating, 1)
+	defer atomic.StoreInt32(&st.updating, 0)
+	defer crash.Recover(lggr, "updating all entries", nil)
+	dc.UpdateAll(ctx)
+}
+
+// track marks the server busy while h runs.
+func (st *state) track(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&st.active, 1)
+		defer func() {
+			atomic.StoreInt64(&st.lastActive, time.Now().UnixNano())
+			atomic.AddInt32(&st.active, -1)
+		}()
+		h(w, r)
+	}
+}
+
+// minIdleCheck is the shortest interval between two idle checks.
+const minIdleCheck = 10 * time.Millisecond
+
+// exitWhenIdle asks the server to exit once no request
+// has been served for timeout.
+func (st *state) exitWhenIdle(timeout time.Duration, ch chan<- os.Signal, lggr *logrus.Logger) {
+	atomic.StoreInt64(&st.lastActive, time.Now().UnixNano())
+	check := timeout / 4
+	if check > time.Minute {
+		check = time.Minute
+	}
+	if check < minIdleCheck {
+		check = minIdleCheck
+	}
+	t := time.NewTicker(check)
+	defer t.Stop()
+	for range t.C {
+		if atomic.LoadInt32(&st.active) > 0 {
+			continue
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&st.lastActive)))
+		if idle >= timeout {
+			lggr.Infof("idle for %v, exiting", idle.Round(time.Second))
+			ch <- os.Interrupt
+			return
+		}
+	}
+}
+
+func statusHandler(st *state, dc cache.Service, ws watcher.Service, sc *sched.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := dc.Stats()
+		if err != nil {
+			writeError(w, CodeDriverFailure, err)
+			return
+		}
+		now := time.Now()
+		status := Status{
+			PID:         os.Getpid(),
+			Version:     CurrentVersion(),
+			Started:     st.started,
+			Uptime:      now.Sub(st.started).Round(time.Second).String(),
+			Socket:      st.socket,
+			DBPath:      stats.Path,
+			DBSize:      stats.Size,
+			Entries:     stats.Entries,
+			Crashes:     crash.Count(),
+			UpdatingAll: atomic.LoadInt32(&st.updating) == 1,
+			Watchers:    []WatcherStatus{},
+			Runs:        []RunStatus{},
+			Scheduler:   schedulerStatus(sc),
+		}
+		for _, s := range ws.Status() {
+			status.Watchers = append(status.Watchers, WatcherStatus{
+				Patterns: s.Patterns,
+				Dir:      s.Dir,
+				Expires:  s.Deadline,
+				Polling:  s.Polling,
+			})
+		}
+		for _, run := range stats.Runs {
+			status.Runs = append(status.Runs, RunStatus{
+				Patterns: run.Patterns,
+				Dir:      run.Dir,
+				Started:  run.Started,
+				Elapsed:  now.Sub(run.Started).Round(time.Millisecond).String(),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestExitWhenIdle(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration
+		active  bool
+		want    bool
+	}{
+		{name: "tiny timeout", timeout: time.Nanosecond, want: true},
+		{name: "idle", timeout: 20 * time.Millisecond, want: true},
+		{name: "busy", timeout: 20 * time.Millisecond, active: true, want: false},
+		{name: "not idle yet", timeout: time.Hour, want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lggr := logrus.New()
+			lggr.SetOutput(ioutil.Discard)
+			st := &state{}
+			if tc.active {
+				atomic.StoreInt32(&st.active, 1)
+			}
+			ch := make(chan os.Signal, 1)
+			go st.exitWhenIdle(tc.timeout, ch, lggr)
+			select {
+			case <-ch:
+				if !tc.want {
+					t.Fatal("exited while not idle")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tc.want {
+					t.Fatal("did not exit when idle")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+)
+
+// ProtocolVersion is bumped whenever the way
+// clients and servers talk to each other changes.
+// Version 2 replaced gob request bodies with Request.
+const ProtocolVersion = 2
+
+// Headers sent by the client with every request.
+const (
+	ProtocolHeader = "Golist-Protocol"
+	BuildIDHeader  = "Golist-Build-Id"
+)
+
+// RequestIDHeader carries the ID the server gave a request.
+// The server's log lines about the request include it.
+const RequestIDHeader = "Golist-Request-Id"
+
+// Version describes a golist binary.
+type Version struct {
+	Protocol int    `json:"protocol"`
+	BuildID  string `json:"build_id"`
+	Version  string `json:"version"`
+}
+
+var (
+	buildIDOnce sync.Once
+	buildID     string
+)
+
+// BuildID identifies the golist executable. It is derived from the
+// executable's path, size and modification time, which is cheap to
+// compute on every client run and changes whenever golist is
+// reinstalled. It is computed once, so a running server keeps
+// reporting the binary it was started from.
+func BuildID() string {
+	buildIDOnce.Do(func() {
+		exe, err := os.Executable()
+		if err != nil {
+			return
+		}
+		fi, err := os.Stat(exe)
+		if err != nil {
+			return
+		}
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s %d %d", exe, fi.Size(), fi.ModTime().UnixNano())))
+		buildID = hex.EncodeToString(sum[:8])
+	})
+	return buildID
+}
+
+// CurrentVersion returns the version of the running binary.
+func CurrentVersion() Version {
+	v := Version{Protocol: ProtocolVersion, BuildID: BuildID(), Version: "(devel)"}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		v.Version = bi.Main.Version
+	}
+	return v
+}
+
+// SetVersionHeaders marks req as coming from this binary.
+func SetVersionHeaders(req *http.Request) {
+	req.Header.Set(ProtocolHeader, strconv.Itoa(ProtocolVersion))
+	req.Header.Set(BuildIDHeader, BuildID())
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CurrentVersion())
+}
+
+// checkVersion rejects requests from clients built from a different
+// binary, so that they restart the server instead of being served by
+// outdated code. Requests without version headers, from older
+// clients or other tools, are let through.
+func checkVersion(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		proto, id := r.Header.Get(ProtocolHeader), r.Header.Get(BuildIDHeader)
+		if proto != "" && proto != strconv.Itoa(ProtocolVersion) || id != "" && id != BuildID() {
+			writeError(w, CodeVersionMismatch, fmt.Errorf(
+				"client (protocol %v, build %v) does not match server (protocol %v, build %v)",
+				proto, id, ProtocolVersion, BuildID(),
+			))
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,161 @@
+package watcher
+
+import (
+	"go/build"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"marwan.io/golist/driver"
+)
+
+// fileFilter decides whether a file event can affect
+// the packages listed for a config, by evaluating the
+// file against the config's build constraints.
+type fileFilter struct {
+	ctxt  *build.Context
+	tests bool
+
+	mu sync.Mutex
+	// matched records whether a file satisfied the build
+	// constraints when it was last seen, so that a file
+	// whose tags changed to exclude it is still noticed.
+	matched map[string]bool
+}
+
+func newFileFilter(cfg *driver.Config) *fileFilter {
+	return &fileFilter{
+		ctxt:    buildContext(cfg),
+		tests:   cfg.Tests,
+		matched: map[string]bool{},
+	}
+}
+
+// seed records the current state of the Go files in dir.
+func (f *fileFilter) seed(dir string) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			f.relevant(filepath.Join(dir, fi.Name()))
+		}
+	}
+}
+
+// sourceExts are the extensions of the files that go list
+// reports as part of a package: Go, cgo, assembly, SWIG,
+// Fortran and Objective-C sources, and system objects.
+var sourceExts = map[string]bool{
+	".go":      true,
+	".c":       true,
+	".cc":      true,
+	".cpp":     true,
+	".cxx":     true,
+	".h":       true,
+	".hh":      true,
+	".hpp":     true,
+	".hxx":     true,
+	".m":       true,
+	".s":       true,
+	".S":       true,
+	".sx":      true,
+	".f":       true,
+	".F":       true,
+	".for":     true,
+	".f90":     true,
+	".swig":    true,
+	".swigcxx": true,
+	".syso":    true,
+}
+
+// relevant reports whether a change to name can
+// change the result of go list for the config.
+func (f *fileFilter) relevant(name string) bool {
+	base := filepath.Base(name)
+	if base == "go.mod" || base == "go.sum" {
+		return true
+	}
+	if !sourceExts[filepath.Ext(base)] {
+		return false
+	}
+	if strings.HasSuffix(base, "_test.go") && !f.tests {
+		return false
+	}
+	// MatchFile fails when the file was removed,
+	// in which case only its previous state matters.
+	now, err := f.ctxt.MatchFile(filepath.Dir(name), base)
+	if err != nil {
+		now = false
+	}
+	f.mu.Lock()
+	was := f.matched[name]
+	f.matched[name] = now
+	f.mu.Unlock()
+	return now || was
+}
+
+// buildContext returns the build context that go list
+// would use for cfg, taking GOOS, GOARCH and CGO_ENABLED
+// from its Env and the build tags from its BuildFlags, or
+// else from the GOFLAGS of its Env.
+func buildContext(cfg *driver.Config) *build.Context {
+	ctxt := build.Default
+	var goflags string
+	for _, kv := range cfg.Env {
+		eq := strings.Index(kv, "=")
+		if eq < 0 {
+			continue
+		}
+		k, v := kv[:eq], kv[eq+1:]
+		switch k {
+		case "GOOS":
+			if v != "" {
+				ctxt.GOOS = v
+			}
+		case "GOARCH":
+			if v != "" {
+				ctxt.GOARCH = v
+			}
+		case "CGO_ENABLED":
+			ctxt.CgoEnabled = v == "1"
+		case "GOFLAGS":
+			goflags = v
+		}
+	}
+	// Flags on the command line override GOFLAGS.
+	ctxt.BuildTags = buildTags(strings.Fields(goflags))
+	if tags := buildTags(cfg.BuildFlags); tags != nil {
+		ctxt.BuildTags = tags
+	}
+	return &ctxt
+}
+
+// buildTags extracts the tags out of -tags flags, accepting both the
+// comma separated form and the older space separated one. It returns
+// nil if there is no -tags flag, and an empty slice for an empty one.
+func buildTags(flags []string) []string {
+	var tags []string
+	for i := 0; i < len(flags); i++ {
+		flag := strings.TrimPrefix(flags[i], "-")
+		var val string
+		switch {
+		case strings.HasPrefix(flag, "-tags="):
+			val = flag[len("-tags="):]
+		case strings.HasPrefix(flag, "tags="):
+			val = flag[len("tags="):]
+		case (flag == "tags" || flag == "-tags") && i+1 < len(flags):
+			i++
+			val = flags[i]
+		default:
+			continue
+		}
+		// The last -tags flag wins, like in the go command.
+		tags = append([]string{}, strings.FieldsFunc(val, func(r rune) bool {
+			return r == ',' || r == ' '
+		})...)
+	}
+	return tags
+}
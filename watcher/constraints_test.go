@@ -0,0 +1,155 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"marwan.io/golist/driver"
+)
+
+func TestBuildTags(t *testing.T) {
+	for _, tc := range []struct {
+		flags []string
+		want  []string
+	}{
+		{flags: nil, want: nil},
+		{flags: []string{"-mod=mod"}, want: nil},
+		{flags: []string{"-tags=a,b"}, want: []string{"a", "b"}},
+		{flags: []string{"--tags=a"}, want: []string{"a"}},
+		{flags: []string{"-tags", "a b"}, want: []string{"a", "b"}},
+		{flags: []string{"-tags=a", "-tags=b"}, want: []string{"b"}},
+		{flags: []string{"-tags="}, want: []string{}},
+		{flags: []string{"-tags"}, want: nil},
+	} {
+		if got := buildTags(tc.flags); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("buildTags(%q) = %#v, want %#v", tc.flags, got, tc.want)
+		}
+	}
+}
+
+func TestBuildContextTags(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		env        []string
+		buildFlags []string
+		want       []string
+	}{
+		{name: "none", want: nil},
+		{name: "build flags", buildFlags: []string{"-tags=a"}, want: []string{"a"}},
+		{name: "goflags", env: []string{"GOFLAGS=-mod=mod -tags=a,b"}, want: []string{"a", "b"}},
+		{name: "last goflags wins", env: []string{"GOFLAGS=-tags=a", "GOFLAGS=-tags=b"}, want: []string{"b"}},
+		{
+			name:       "build flags override goflags",
+			env:        []string{"GOFLAGS=-tags=a"},
+			buildFlags: []string{"-tags=b"},
+			want:       []string{"b"},
+		},
+		{
+			name:       "empty build flag clears goflags",
+			env:        []string{"GOFLAGS=-tags=a"},
+			buildFlags: []string{"-tags="},
+			want:       []string{},
+		},
+	} {
+		ctxt := buildContext(&driver.Config{Env: tc.env, BuildFlags: tc.buildFlags})
+		if !reflect.DeepEqual(ctxt.BuildTags, tc.want) {
+			t.Errorf("%v: BuildTags = %#v, want %#v", tc.name, ctxt.BuildTags, tc.want)
+		}
+	}
+}
+
+func TestRelevant(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go":        "package a\n",
+		"tagged.go":   "//go:build foo\n\npackage a\n",
+		"a_test.go":   "package a\n",
+		"a_plan9.go":  "package a\n",
+		"asm_amd64.s": "",
+		"asm_plan9.s": "",
+		"cgo.c":       "",
+		"cgo.h":       "",
+		"rsrc.syso":   "",
+		"README.md":   "",
+		"data.json":   "",
+		"go.mod":      "module a\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		cfg   driver.Config
+		files map[string]bool
+	}{
+		{
+			name: "defaults",
+			cfg:  driver.Config{Env: []string{"GOOS=linux", "GOARCH=amd64"}},
+			files: map[string]bool{
+				"a.go":        true,
+				"tagged.go":   false,
+				"a_test.go":   false,
+				"a_plan9.go":  false,
+				"asm_amd64.s": true,
+				"asm_plan9.s": false,
+				"cgo.c":       true,
+				"cgo.h":       true,
+				"rsrc.syso":   true,
+				"README.md":   false,
+				"data.json":   false,
+				"go.mod":      true,
+			},
+		},
+		{
+			name: "tests and tags",
+			cfg: driver.Config{
+				Env:   []string{"GOOS=linux", "GOARCH=amd64", "GOFLAGS=-tags=foo"},
+				Tests: true,
+			},
+			files: map[string]bool{
+				"tagged.go": true,
+				"a_test.go": true,
+			},
+		},
+		{
+			name: "other platform",
+			cfg:  driver.Config{Env: []string{"GOOS=plan9", "GOARCH=386"}},
+			files: map[string]bool{
+				"a_plan9.go":  true,
+				"asm_amd64.s": false,
+				"asm_plan9.s": true,
+			},
+		},
+	} {
+		f := newFileFilter(&tc.cfg)
+		for name, want := range tc.files {
+			if got := f.relevant(filepath.Join(dir, name)); got != want {
+				t.Errorf("%v: relevant(%v) = %v, want %v", tc.name, name, got, want)
+			}
+		}
+	}
+}
+
+func TestRelevantRemembersMatches(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(name, []byte("package a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f := newFileFilter(&driver.Config{})
+	f.seed(dir)
+	// Adding a constraint that excludes the file still
+	// changes the packages, but the next edit does not.
+	if err := ioutil.WriteFile(name, []byte("//go:build ignore\n\npackage a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false} {
+		if got := f.relevant(name); got != want {
+			t.Errorf("relevant() #%d = %v, want %v", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package watcher
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"marwan.io/golist/pathutil"
+)
+
+// editorPatterns match the temporary, backup and lock
+// files that editors write next to the files being edited.
+var editorPatterns = []string{
+	// vim
+	"*.swp", "*.swo", "*.swx", "*.swpx", "4913",
+	// emacs
+	".#*", "#*#", "*~",
+	// JetBrains safe write
+	"*___jb_tmp___", "*___jb_old___",
+	// kate, gedit and friends
+	".*.kate-swp", ".goutputstream-*",
+	// macOS
+	".DS_Store",
+}
+
+// vcsDirs are never of interest to go list.
+var vcsDirs = []string{".git", ".hg", ".svn", ".bzr"}
+
+// ignorer decides which file events are noise. It combines
+// the built-in editor patterns, the .gitignore files of the
+// repository containing a file, and user supplied patterns.
+type ignorer struct {
+	user []ignoreRule
+	// abs are the user patterns that are absolute paths.
+	abs []ignoreRule
+	// repo are the user patterns that are
+	// relative to the repository root.
+	repo []ignoreRule
+
+	mu         sync.Mutex
+	gitignores map[string]*gitignore
+	roots      map[string]string
+}
+
+type gitignore struct {
+	modTime time.Time
+	rules   []ignoreRule
+}
+
+func newIgnorer(patterns []string) *ignorer {
+	ig := &ignorer{
+		gitignores: map[string]*gitignore{},
+		roots:      map[string]string{},
+	}
+	for _, p := range append(editorPatterns, patterns...) {
+		r, ok := parseIgnoreRule(p)
+		switch {
+		case !ok:
+		case filepath.IsAbs(p):
+			r.base = string(filepath.Separator)
+			ig.user = append(ig.user, r)
+			ig.abs = append(ig.abs, r)
+		case r.anchored:
+			ig.repo = append(ig.repo, r)
+		default:
+			ig.user = append(ig.user, r)
+		}
+	}
+	return ig
+}
+
+// ignored reports whether an event on name should be dropped.
+func (ig *ignorer) ignored(name string) bool {
+	name = filepath.Clean(name)
+	for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+		for _, vcs := range vcsDirs {
+			if elem == vcs {
+				return true
+			}
+		}
+	}
+	// The editor and user patterns only apply below the repository
+	// root or, outside of one, to the files of the watched directory:
+	// the directories above are not for them to ignore, save for
+	// absolute patterns.
+	stop := ig.repoRoot(filepath.Dir(name))
+	if stop == "" {
+		stop = filepath.Dir(name)
+	}
+	for p, isDir := name, false; ; p, isDir = filepath.Dir(p), true {
+		rules := ig.abs
+		if p != stop && pathutil.Within(stop, p) {
+			rules = ig.user
+		}
+		if matchRules(rules, p, isDir) {
+			return true
+		}
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+	return ig.gitIgnored(name)
+}
+
+// gitIgnored evaluates the .gitignore files from the repository
+// root down to name's directory. As in git, a file inside an
+// ignored directory is ignored no matter what.
+func (ig *ignorer) gitIgnored(name string) bool {
+	root := ig.repoRoot(filepath.Dir(name))
+	if root == "" {
+		return false
+	}
+	if !pathutil.Within(root, name) {
+		return false
+	}
+	rel, _ := filepath.Rel(root, name)
+	elems := strings.Split(filepath.ToSlash(rel), "/")
+	dir := root
+	var rules []ignoreRule
+	for _, r := range ig.repo {
+		r.base = root
+		rules = append(rules, r)
+	}
+	for i, elem := range elems {
+		rules = append(rules, ig.gitignoreRules(dir)...)
+		p := filepath.Join(dir, elem)
+		isDir := i < len(elems)-1
+		if matchRules(rules, p, isDir) {
+			return true
+		}
+		dir = p
+	}
+	return false
+}
+
+// matchRules returns the verdict of the last rule matching p.
+func matchRules(rules []ignoreRule, p string, isDir bool) bool {
+	ignored := false
+	for _, r := range rules {
+		rel := p
+		if r.base != "" {
+			var err error
+			if rel, err = filepath.Rel(r.base, p); err != nil {
+				continue
+			}
+		}
+		if r.match(filepath.ToSlash(rel), isDir) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// repoRoot returns the closest parent of dir that contains
+// a .git entry, or "" if dir is not inside a repository.
+func (ig *ignorer) repoRoot(dir string) string {
+	ig.mu.Lock()
+	root, ok := ig.roots[dir]
+	ig.mu.Unlock()
+	if ok {
+		return root
+	}
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			root = d
+			break
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			break
+		}
+		d = parent
+	}
+	ig.mu.Lock()
+	ig.roots[dir] = root
+	ig.mu.Unlock()
+	return root
+}
+
+// gitignoreRules returns the rules of dir/.gitignore,
+// re-reading the file whenever it changes.
+func (ig *ignorer) gitignoreRules(dir string) []ignoreRule {
+	file := filepath.Join(dir, ".gitignore")
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil
+	}
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	gi, ok := ig.gitignores[file]
+	if ok && gi.modTime.Equal(fi.ModTime()) {
+		return gi.rules
+	}
+	gi = &gitignore{modTime: fi.ModTime()}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if r, ok := parseIgnoreRule(scanner.Text()); ok {
+			r.base = dir
+			gi.rules = append(gi.rules, r)
+		}
+	}
+	ig.gitignores[file] = gi
+	return gi.rules
+}
+
+// ignoreRule is a single gitignore style pattern.
+type ignoreRule struct {
+	// base is the directory an anchored pattern is relative
+	// to. Unanchored patterns have no base.
+	base     string
+	segs     []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	var r ignoreRule
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false
+	}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A slash anywhere but at the end anchors the
+	// pattern to the directory of its .gitignore.
+	if strings.Contains(line, "/") {
+		r.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return r, false
+	}
+	r.segs = strings.Split(line, "/")
+	return r, true
+}
+
+// match reports whether the slash separated path p, relative to
+// the rule's base, matches. Unanchored rules match the last
+// element of p, since every parent is checked on its own.
+func (r ignoreRule) match(p string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	elems := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if !r.anchored {
+		ok, _ := path.Match(r.segs[0], elems[len(elems)-1])
+		return ok
+	}
+	return matchSegs(r.segs, elems)
+}
+
+// matchSegs matches path elements against pattern
+// segments, where "**" matches any number of elements.
+func matchSegs(segs, elems []string) bool {
+	if len(segs) == 0 {
+		return len(elems) == 0
+	}
+	if segs[0] == "**" {
+		for i := 0; i <= len(elems); i++ {
+			if matchSegs(segs[1:], elems[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elems) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(segs[0], elems[0]); !ok {
+		return false
+	}
+	return matchSegs(segs[1:], elems[1:])
+}
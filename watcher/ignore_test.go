@@ -0,0 +1,132 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIgnoreRuleMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		// Unanchored patterns match the last element.
+		{pattern: "*.tmp", path: "a.tmp", want: true},
+		{pattern: "*.tmp", path: "pkg/a.tmp", want: true},
+		{pattern: "*.tmp", path: "a.go", want: false},
+		{pattern: "gen", path: "pkg/gen", isDir: true, want: true},
+		// Anchored patterns match from the base.
+		{pattern: "/gen", path: "gen", isDir: true, want: true},
+		{pattern: "/gen", path: "pkg/gen", isDir: true, want: false},
+		{pattern: "pkg/*.pb.go", path: "pkg/a.pb.go", want: true},
+		{pattern: "pkg/*.pb.go", path: "other/pkg/a.pb.go", want: false},
+		{pattern: "a/**/b", path: "a/b", isDir: true, want: true},
+		{pattern: "a/**/b", path: "a/x/y/b", isDir: true, want: true},
+		{pattern: "**/testdata", path: "x/testdata", isDir: true, want: true},
+		// Dir-only patterns skip files.
+		{pattern: "out/", path: "out", isDir: true, want: true},
+		{pattern: "out/", path: "out", want: false},
+		{pattern: "/out/", path: "out", isDir: true, want: true},
+		{pattern: "/out/", path: "out", want: false},
+		// Negated patterns match like the others;
+		// matchRules turns their match into a keep.
+		{pattern: "!keep.tmp", path: "keep.tmp", want: true},
+		{pattern: "!/keep.tmp", path: "pkg/keep.tmp", want: false},
+	} {
+		r, ok := parseIgnoreRule(tc.pattern)
+		if !ok {
+			t.Fatalf("parseIgnoreRule(%q) failed", tc.pattern)
+		}
+		if got := r.match(tc.path, tc.isDir); got != tc.want {
+			t.Errorf("%q.match(%q, %v) = %v, want %v", tc.pattern, tc.path, tc.isDir, got, tc.want)
+		}
+	}
+}
+
+func TestParseIgnoreRule(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		ok   bool
+		want ignoreRule
+	}{
+		{line: "", ok: false},
+		{line: "# comment", ok: false},
+		{line: "/", ok: false},
+		{line: "*.go  ", ok: true, want: ignoreRule{segs: []string{"*.go"}}},
+		{line: "!a", ok: true, want: ignoreRule{segs: []string{"a"}, negate: true}},
+		{line: "a/", ok: true, want: ignoreRule{segs: []string{"a"}, dirOnly: true}},
+		{line: "/a/b", ok: true, want: ignoreRule{segs: []string{"a", "b"}, anchored: true}},
+	} {
+		r, ok := parseIgnoreRule(tc.line)
+		if ok != tc.ok {
+			t.Errorf("parseIgnoreRule(%q) ok = %v, want %v", tc.line, ok, tc.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if !reflect.DeepEqual(r, tc.want) {
+			t.Errorf("parseIgnoreRule(%q) = %+v, want %+v", tc.line, r, tc.want)
+		}
+	}
+}
+
+func TestMatchRulesNegation(t *testing.T) {
+	var rules []ignoreRule
+	for _, p := range []string{"*.tmp", "!keep.tmp"} {
+		r, _ := parseIgnoreRule(p)
+		rules = append(rules, r)
+	}
+	for _, tc := range []struct {
+		path string
+		want bool
+	}{
+		{path: "a.tmp", want: true},
+		{path: "keep.tmp", want: false},
+		{path: "a.go", want: false},
+	} {
+		if got := matchRules(rules, tc.path, false); got != tc.want {
+			t.Errorf("matchRules(%q) = %v, want %v", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	// The directories above the repository are named like
+	// the patterns, which must not ignore everything below.
+	repo := filepath.Join(t.TempDir(), "build", "repo")
+	for _, dir := range []string{".git", "pkg", "build", "out/gen"} {
+		if err := os.MkdirAll(filepath.Join(repo, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(repo, ".gitignore"), []byte("*.pb.go\n!keep.pb.go\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ig := newIgnorer([]string{"build", "out/", filepath.Join(repo, "pkg", "abs.go")})
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{name: "pkg/a.go", want: false},
+		{name: "pkg/a.go~", want: true},
+		{name: "pkg/.a.go.swp", want: true},
+		{name: "build/a.go", want: true},
+		{name: "out/gen/a.go", want: true},
+		{name: "pkg/abs.go", want: true},
+		{name: "pkg/a.pb.go", want: true},
+		{name: "pkg/keep.pb.go", want: false},
+		{name: "..a.pb.go", want: true},
+		{name: ".git/HEAD", want: true},
+	} {
+		name := filepath.Join(repo, filepath.FromSlash(tc.name))
+		if got := ig.ignored(name); got != tc.want {
+			t.Errorf("ignored(%v) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
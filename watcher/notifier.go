@@ -0,0 +1,203 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// notifier is the file system backend of a job.
+// It is implemented by fsnotify and by a stat based poller
+// for file systems where native notifications are not available.
+type notifier interface {
+	Add(name string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+type nativeNotifier struct {
+	w *fsnotify.Watcher
+}
+
+func newNativeNotifier() (notifier, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &nativeNotifier{w: w}, nil
+}
+
+func (n *nativeNotifier) Add(name string) error         { return n.w.Add(name) }
+func (n *nativeNotifier) Events() <-chan fsnotify.Event { return n.w.Events }
+func (n *nativeNotifier) Errors() <-chan error          { return n.w.Errors }
+func (n *nativeNotifier) Close() error                  { return n.w.Close() }
+
+// defaultPollInterval is how often the poller stats
+// its files when no interval is given.
+const defaultPollInterval = 2 * time.Second
+
+// pollNotifier emulates fsnotify by stat'ing every added
+// file on an interval. Like fsnotify, adding a directory
+// watches its immediate children.
+type pollNotifier struct {
+	interval time.Duration
+	mu       sync.Mutex
+	roots    map[string]bool
+	state    map[string]fileState
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan struct{}
+	once     sync.Once
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+func newPollNotifier(interval time.Duration) notifier {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	p := &pollNotifier{
+		interval: interval,
+		roots:    map[string]bool{},
+		state:    map[string]fileState{},
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *pollNotifier) Add(name string) error {
+	snap := map[string]fileState{}
+	if err := snapshot(name, snap); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.roots[name] = true
+	for path, st := range snap {
+		p.state[path] = st
+	}
+	return nil
+}
+
+func (p *pollNotifier) Events() <-chan fsnotify.Event { return p.events }
+func (p *pollNotifier) Errors() <-chan error          { return p.errors }
+
+func (p *pollNotifier) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+func (p *pollNotifier) run() {
+	defer close(p.events)
+	defer close(p.errors)
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		}
+		for _, ev := range p.scan() {
+			select {
+			case p.events <- ev:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+// scan stats every root and returns the
+// differences from the previous scan as events.
+func (p *pollNotifier) scan() []fsnotify.Event {
+	p.mu.Lock()
+	roots := make([]string, 0, len(p.roots))
+	for root := range p.roots {
+		roots = append(roots, root)
+	}
+	p.mu.Unlock()
+
+	next := map[string]fileState{}
+	for _, root := range roots {
+		if err := snapshot(root, next); err != nil && !os.IsNotExist(err) {
+			select {
+			case p.errors <- err:
+			case <-p.done:
+				return nil
+			}
+		}
+	}
+
+	scanned := make(map[string]bool, len(roots))
+	for _, root := range roots {
+		scanned[root] = true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Keep what Add recorded for roots added during the scan:
+	// they were not scanned, so their files are not in next.
+	for path, st := range p.state {
+		if _, ok := next[path]; !ok && !scanned[path] && !scanned[filepath.Dir(path)] {
+			next[path] = st
+		}
+	}
+	var events []fsnotify.Event
+	for path, st := range next {
+		old, ok := p.state[path]
+		switch {
+		case !ok:
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+		case old != st && !st.mode.IsDir():
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+		}
+	}
+	for path := range p.state {
+		if _, ok := next[path]; !ok {
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+		}
+	}
+	p.state = next
+	return events
+}
+
+// snapshot records the state of name, and of its
+// children if name is a directory, into snap.
+func snapshot(name string, snap map[string]fileState) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	snap[name] = stateOf(fi)
+	if !fi.IsDir() {
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	children, err := f.Readdir(-1)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		snap[filepath.Join(name, child.Name())] = stateOf(child)
+	}
+	return nil
+}
+
+func stateOf(fi os.FileInfo) fileState {
+	return fileState{modTime: fi.ModTime(), size: fi.Size(), mode: fi.Mode()}
+}
@@ -0,0 +1,121 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestPollScan(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		change func(t *testing.T, dir string)
+		want   []fsnotify.Event
+	}{
+		{
+			name:   "no change",
+			change: func(*testing.T, string) {},
+		},
+		{
+			name: "create",
+			change: func(t *testing.T, dir string) {
+				writeTestFile(t, filepath.Join(dir, "b.go"), "package a")
+			},
+			want: []fsnotify.Event{{Name: "b.go", Op: fsnotify.Create}},
+		},
+		{
+			name: "write",
+			change: func(t *testing.T, dir string) {
+				writeTestFile(t, filepath.Join(dir, "a.go"), "package a // longer")
+			},
+			want: []fsnotify.Event{{Name: "a.go", Op: fsnotify.Write}},
+		},
+		{
+			name: "remove",
+			change: func(t *testing.T, dir string) {
+				if err := os.Remove(filepath.Join(dir, "a.go")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []fsnotify.Event{{Name: "a.go", Op: fsnotify.Remove}},
+		},
+		{
+			name: "new directory",
+			change: func(t *testing.T, dir string) {
+				if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []fsnotify.Event{{Name: "sub", Op: fsnotify.Create}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestFile(t, filepath.Join(dir, "a.go"), "package a")
+			p := &pollNotifier{roots: map[string]bool{}, state: map[string]fileState{}, done: make(chan struct{})}
+			if err := p.Add(dir); err != nil {
+				t.Fatal(err)
+			}
+			tc.change(t, dir)
+			got := relEvents(t, dir, p.scan())
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("scan() = %v, want %v", got, tc.want)
+			}
+			if events := p.scan(); len(events) != 0 {
+				t.Fatalf("second scan() = %v, want no events", events)
+			}
+		})
+	}
+}
+
+func TestPollScanKeepsLaterRoots(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(second, "a.go"), "package a")
+	p := &pollNotifier{roots: map[string]bool{}, state: map[string]fileState{}, done: make(chan struct{})}
+	if err := p.Add(first); err != nil {
+		t.Fatal(err)
+	}
+	// second is added while a scan of first runs: its state is
+	// recorded, but the scan does not stat it.
+	snap := map[string]fileState{}
+	if err := snapshot(second, snap); err != nil {
+		t.Fatal(err)
+	}
+	for path, st := range snap {
+		p.state[path] = st
+	}
+	if events := p.scan(); len(events) != 0 {
+		t.Fatalf("scan() = %v, want no events", events)
+	}
+	p.roots[second] = true
+	if events := p.scan(); len(events) != 0 {
+		t.Fatalf("scan() after adding the root = %v, want no events", events)
+	}
+}
+
+func writeTestFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// relEvents makes the names of events relative to dir and sorts them.
+func relEvents(t *testing.T, dir string, events []fsnotify.Event) []fsnotify.Event {
+	t.Helper()
+	var rel []fsnotify.Event
+	for _, ev := range events {
+		name, err := filepath.Rel(dir, ev.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel = append(rel, fsnotify.Event{Name: name, Op: ev.Op})
+	}
+	sort.Slice(rel, func(i, j int) bool { return rel[i].Name < rel[j].Name })
+	return rel
+}
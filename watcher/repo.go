@@ -0,0 +1,339 @@
+package watcher
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"marwan.io/golist/cache"
+	"marwan.io/golist/crash"
+	"marwan.io/golist/driver"
+	"marwan.io/golist/pathutil"
+)
+
+// quietPeriod is how long a repository must go without
+// git or file events before a paused repository is revalidated.
+const quietPeriod = time.Second
+
+// bulkTimeout bounds the revalidation of a whole repository.
+const bulkTimeout = 5 * time.Minute
+
+// repoWatcher watches the git state of a repository containing
+// watched configs. A branch switch rewrites many files at once, so
+// instead of letting every job refresh mid-checkout, it pauses
+// the refreshes of the repository's jobs until the tree is quiet
+// and then revalidates every cache entry under the repository in
+// one pass.
+//
+// git takes index.lock before it rewrites the tree and the index,
+// and HEAD.lock before it moves HEAD, so the pause starts with
+// those locks, and with HEAD or the ref it points to moving. Most
+// git commands that take them, like git status, git add or git
+// commit, leave the tree alone: if no job deferred a refresh
+// during the pause, the revalidation is skipped.
+type repoWatcher struct {
+	root   string
+	gitDir string
+	w      notifier
+	dc     cache.Service
+	lggr   *logrus.Logger
+
+	// checkout, refFile and dirs are only used by run,
+	// once repo has set them up.
+	checkout checkout
+	refFile  string
+	dirs     map[string]bool
+
+	mu     sync.Mutex
+	refs   int
+	paused bool
+	// deferred is set once a job deferred
+	// its refresh during the pause.
+	deferred bool
+	gen      int
+	timer    *time.Timer
+}
+
+// repo returns the watcher of the repository at root,
+// starting it if needed. It must be called with s.mu held.
+func (s *service) repo(root string) *repoWatcher {
+	r, ok := s.repos[root]
+	if ok {
+		r.refs++
+		return r
+	}
+	gitDir := gitDir(root)
+	w, err := s.notify([]string{gitDir})
+	if err != nil {
+		s.lggr.Errorf("could not watch git dir %v: %v", gitDir, err)
+		return nil
+	}
+	r = &repoWatcher{root: root, gitDir: gitDir, w: w, dc: s.dc, lggr: s.lggr, refs: 1}
+	r.dirs = map[string]bool{gitDir: true}
+	r.checkout, r.refFile = readCheckout(gitDir)
+	r.watchRef()
+	s.repos[root] = r
+	go r.run()
+	return r
+}
+
+// release drops a job's reference to r, closing it with the
+// last one. It must be called with s.mu held.
+func (s *service) release(r *repoWatcher) {
+	if r == nil {
+		return
+	}
+	r.refs--
+	if r.refs > 0 {
+		return
+	}
+	delete(s.repos, r.root)
+	r.close()
+}
+
+// gitDir resolves the git directory of the repository at root,
+// following the "gitdir:" file of worktrees and submodules.
+func gitDir(root string) string {
+	dotgit := filepath.Join(root, ".git")
+	bts, err := ioutil.ReadFile(dotgit)
+	if err != nil || !strings.HasPrefix(string(bts), "gitdir:") {
+		return dotgit
+	}
+	dir := strings.TrimSpace(strings.TrimPrefix(string(bts), "gitdir:"))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	return dir
+}
+
+// commonDir returns the directory holding the refs of the git
+// directory gitDir, which differs from it for linked worktrees.
+func commonDir(gitDir string) string {
+	bts, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+	dir := strings.TrimSpace(string(bts))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(gitDir, dir)
+	}
+	return filepath.Clean(dir)
+}
+
+// checkout is what a repository has checked out.
+type checkout struct {
+	// head is the content of HEAD: a ref, or
+	// a commit when HEAD is detached.
+	head string
+	// commit is the commit of the ref of head.
+	commit string
+}
+
+// readCheckout reads the checkout of the git directory gitDir,
+// and returns the loose file of the ref HEAD points to, if any.
+func readCheckout(gitDir string) (checkout, string) {
+	var co checkout
+	bts, err := ioutil.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return co, ""
+	}
+	co.head = strings.TrimSpace(string(bts))
+	if !strings.HasPrefix(co.head, "ref: ") {
+		return co, ""
+	}
+	ref := strings.TrimPrefix(co.head, "ref: ")
+	common := commonDir(gitDir)
+	refFile := filepath.Join(common, filepath.FromSlash(ref))
+	if bts, err := ioutil.ReadFile(refFile); err == nil {
+		co.commit = strings.TrimSpace(string(bts))
+	} else {
+		co.commit = packedRef(common, ref)
+	}
+	return co, refFile
+}
+
+// packedRef returns the commit of ref in the packed-refs
+// file of common, or "" if it is not there.
+func packedRef(common, ref string) string {
+	bts, err := ioutil.ReadFile(filepath.Join(common, "packed-refs"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(bts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == ref {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// watchRef adds the directories of the current ref
+// and of the packed refs to the notifier, as git
+// replaces those files instead of writing them.
+func (r *repoWatcher) watchRef() {
+	dirs := []string{commonDir(r.gitDir)}
+	if r.refFile != "" {
+		dirs = append(dirs, filepath.Dir(r.refFile))
+	}
+	for _, dir := range dirs {
+		if r.dirs[dir] {
+			continue
+		}
+		if err := r.w.Add(dir); err != nil {
+			r.lggr.Errorf("could not watch %v: %v", dir, err)
+			continue
+		}
+		r.dirs[dir] = true
+	}
+}
+
+// lockEvent reports whether event is git taking
+// the lock of the index or of HEAD.
+func (r *repoWatcher) lockEvent(event fsnotify.Event) bool {
+	if event.Op&fsnotify.Create == 0 {
+		return false
+	}
+	return event.Name == filepath.Join(r.gitDir, "index.lock") ||
+		event.Name == filepath.Join(r.gitDir, "HEAD.lock")
+}
+
+// gitEvent reports whether event may have changed the checkout.
+func (r *repoWatcher) gitEvent(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	switch {
+	case event.Name == filepath.Join(r.gitDir, "HEAD"),
+		event.Name == filepath.Join(commonDir(r.gitDir), "packed-refs"),
+		r.refFile != "" && event.Name == r.refFile:
+		return true
+	}
+	return false
+}
+
+func (r *repoWatcher) run() {
+	defer crash.Recover(r.lggr, "watching "+r.root, nil)
+	for {
+		select {
+		case event, ok := <-r.w.Events():
+			if !ok {
+				return
+			}
+			if r.lockEvent(event) {
+				r.lggr.Debugf("%v: git took %v. Pausing refreshes", r.root, filepath.Base(event.Name))
+				r.pause()
+				continue
+			}
+			if !r.gitEvent(event) {
+				continue
+			}
+			co, refFile := readCheckout(r.gitDir)
+			if co == r.checkout {
+				continue
+			}
+			r.lggr.Debugf("%v: checkout changed from %v to %v (%v). Pausing refreshes", r.root, r.checkout, co, event)
+			r.checkout, r.refFile = co, refFile
+			r.watchRef()
+			r.pause()
+		case err, ok := <-r.w.Errors():
+			if !ok {
+				return
+			}
+			r.lggr.Errorf("REPO WATCHER ERR: %v", err)
+			watchErrors.Inc()
+		}
+	}
+}
+
+// pause holds off the refreshes of the repository's jobs
+// and (re)starts the wait for the tree to become quiet.
+func (r *repoWatcher) pause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paused = true
+	r.wait()
+}
+
+// deferRefresh reports whether a job should skip its refresh because
+// the repository is paused. The job's event counts as activity,
+// which pushes the revalidation back.
+func (r *repoWatcher) deferRefresh() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.paused {
+		return false
+	}
+	r.deferred = true
+	r.wait()
+	return true
+}
+
+// wait restarts the quiet period. It must be called with r.mu held.
+func (r *repoWatcher) wait() {
+	r.gen++
+	gen := r.gen
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer = time.AfterFunc(quietPeriod, func() { r.resume(gen) })
+}
+
+func (r *repoWatcher) resume(gen int) {
+	defer crash.Recover(r.lggr, "revalidating "+r.root, nil)
+	r.mu.Lock()
+	if gen != r.gen || !r.paused {
+		r.mu.Unlock()
+		return
+	}
+	r.paused = false
+	r.timer = nil
+	deferred := r.deferred
+	r.deferred = false
+	r.mu.Unlock()
+
+	if !deferred {
+		r.lggr.Debugf("%v: no watched file changed. Skipping revalidation", r.root)
+		return
+	}
+	r.lggr.Debugf("%v: tree is quiet. Revalidating all entries", r.root)
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+	err := r.dc.UpdateMatching(ctx, func(cfg *driver.Config) bool {
+		return underRoot(cfg, r.root)
+	})
+	if err != nil {
+		r.lggr.Errorf("%v: could not revalidate: %v", r.root, err)
+	}
+}
+
+func (r *repoWatcher) close() {
+	r.mu.Lock()
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.gen++
+	r.mu.Unlock()
+	r.w.Close()
+}
+
+// underRoot reports whether cfg lists packages from inside root.
+func underRoot(cfg *driver.Config, root string) bool {
+	if pathutil.Within(root, cfg.Dir) {
+		return true
+	}
+	for _, pattern := range cfg.Patterns {
+		if strings.HasPrefix(pattern, "file=") && pathutil.Within(root, pattern[len("file="):]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package watcher
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"marwan.io/golist/cache"
+	"marwan.io/golist/driver"
+)
+
+// updateCounter is a cache counting its bulk revalidations.
+type updateCounter struct {
+	cache.Service
+	updates int
+}
+
+func (c *updateCounter) UpdateMatching(ctx context.Context, match func(cfg *driver.Config) bool) error {
+	c.updates++
+	return nil
+}
+
+func TestRepoResume(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		deferred bool
+		want     int
+	}{
+		{name: "tree unchanged", deferred: false, want: 0},
+		{name: "refresh deferred", deferred: true, want: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lggr := logrus.New()
+			lggr.SetOutput(ioutil.Discard)
+			dc := &updateCounter{}
+			r := &repoWatcher{root: t.TempDir(), dc: dc, lggr: lggr}
+			r.pause()
+			if tc.deferred && !r.deferRefresh() {
+				t.Fatal("refresh not deferred while paused")
+			}
+			r.mu.Lock()
+			gen := r.gen
+			r.timer.Stop()
+			r.mu.Unlock()
+			r.resume(gen)
+			if dc.updates != tc.want {
+				t.Fatalf("revalidated %d times, want %d", dc.updates, tc.want)
+			}
+			if r.deferRefresh() {
+				t.Fatal("refresh deferred after resuming")
+			}
+		})
+	}
+}
+
+func TestRepoEvents(t *testing.T) {
+	gitDir := filepath.Join(t.TempDir(), ".git")
+	r := &repoWatcher{gitDir: gitDir, refFile: filepath.Join(gitDir, "refs", "heads", "main")}
+	for _, tc := range []struct {
+		name     string
+		op       fsnotify.Op
+		wantLock bool
+		wantGit  bool
+	}{
+		{name: "index.lock", op: fsnotify.Create, wantLock: true},
+		{name: "index.lock", op: fsnotify.Remove, wantLock: false},
+		{name: "HEAD.lock", op: fsnotify.Create, wantLock: true},
+		{name: "HEAD", op: fsnotify.Create, wantGit: true},
+		{name: "HEAD", op: fsnotify.Chmod, wantGit: false},
+		{name: "refs/heads/main", op: fsnotify.Write, wantGit: true},
+		{name: "refs/heads/other", op: fsnotify.Write, wantGit: false},
+		{name: "packed-refs", op: fsnotify.Create, wantGit: true},
+		{name: "index", op: fsnotify.Write, wantGit: false},
+	} {
+		event := fsnotify.Event{Name: filepath.Join(gitDir, filepath.FromSlash(tc.name)), Op: tc.op}
+		if got := r.lockEvent(event); got != tc.wantLock {
+			t.Errorf("lockEvent(%v) = %v, want %v", event, got, tc.wantLock)
+		}
+		if got := r.gitEvent(event); got != tc.wantGit {
+			t.Errorf("gitEvent(%v) = %v, want %v", event, got, tc.wantGit)
+		}
+	}
+}
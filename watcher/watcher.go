@@ -2,20 +2,60 @@ package watcher
 
 import (
 	"context"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 	"marwan.io/golist/cache"
+	"marwan.io/golist/crash"
 	"marwan.io/golist/driver"
+	"marwan.io/golist/events"
 	"marwan.io/golist/hash"
+	"marwan.io/golist/logging"
+	"marwan.io/golist/metrics"
 )
 
+var watchErrors = metrics.NewCounter("golist_watcher_errors_total", "Errors reported by file system notifications.")
+
+// Options configures the watcher service.
+type Options struct {
+	// Poll makes every job stat its files on an interval
+	// instead of relying on native file system notifications.
+	// Polling is also used automatically when native watching fails.
+	Poll bool
+	// PollInterval is how often polling jobs check their files.
+	PollInterval time.Duration
+	// Expiry is how long a job keeps watching after
+	// its last use. It defaults to an hour. When a job expires,
+	// its cache entry is marked unverified.
+	Expiry time.Duration
+	// Ignore lists gitignore style patterns of files whose
+	// events are dropped, on top of the built-in editor
+	// patterns and the repository's .gitignore files.
+	Ignore []string
+	// Events receives the expirations of watchers. It may be nil.
+	Events *events.Bus
+	// RefreshTimeout bounds the refresh of an entry after
+	// its files changed. It defaults to 30 seconds.
+	RefreshTimeout time.Duration
+}
+
 // NewService returns a new watcher
-func NewService(dc cache.Service, lggr *logrus.Logger) Service {
-	s := &service{}
+func NewService(dc cache.Service, lggr *logrus.Logger, opts Options) Service {
+	if opts.Expiry <= 0 {
+		opts.Expiry = defaultExpiry
+	}
+	if opts.RefreshTimeout <= 0 {
+		opts.RefreshTimeout = defaultRefreshTimeout
+	}
+	s := &service{opts: opts}
+	s.ignore = newIgnorer(opts.Ignore)
+	s.repos = map[string]*repoWatcher{}
 	s.watchers = map[string]*job{}
 	if lggr == nil {
 		lggr = logrus.New()
@@ -30,88 +70,299 @@ func NewService(dc cache.Service, lggr *logrus.Logger) Service {
 // and update the golist results
 // if anything changes in your .go files.
 type Service interface {
-	Watch(cfg *driver.Config) error
+	// Watch refreshes the entry of cfg whenever its files change.
+	// The watcher logs with the request ID of ctx, so that
+	// refreshes can be traced to the latest request for cfg.
+	Watch(ctx context.Context, cfg *driver.Config) error
+	// Restore restarts the watchers that were persisted
+	// in the cache and have not expired yet.
+	Restore() error
+	// Status describes the running watchers.
+	Status() []Status
 	Close() error
 }
 
+// Status describes a running watcher.
+type Status struct {
+	Patterns []string
+	Dir      string
+	Deadline time.Time
+	// Polling is true when the watcher stats its files on
+	// an interval instead of using native notifications.
+	Polling bool
+}
+
 type service struct {
 	watchers map[string]*job
 	mu       sync.Mutex
 	lggr     *logrus.Logger
 	dc       cache.Service
+	opts     Options
+	ignore   *ignorer
+	repos    map[string]*repoWatcher
 }
 
-func (s *service) Watch(cfg *driver.Config) error {
+func (s *service) Watch(ctx context.Context, cfg *driver.Config) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	id := logging.ID(ctx)
 	key := hash.KeyString(cfg)
 	j, ok := s.watchers[key]
 	if ok {
-		s.lggr.Debugf("%v: already has watcher", cfg.Patterns)
+		logging.Entry(s.lggr, id).Debugf("%v: already has watcher", cfg.Patterns)
+		j.requestID.Store(id)
 		j.requestExtension()
 		// TODO: one watcher for all configs
 		return nil
 	}
+	j, err := s.start(key, cfg, time.Now().Add(s.opts.Expiry))
+	if err != nil {
+		return err
+	}
+	j.requestID.Store(id)
+	j.log().Infof("%v: watching for %v", cfg.Patterns, s.opts.Expiry)
+	go j.persist()
+	return nil
+}
 
-	w, err := fsnotify.NewWatcher()
+func (s *service) Restore() error {
+	watches, err := s.dc.Watches()
 	if err != nil {
 		return err
 	}
-	j = &job{w: w, dc: s.dc}
-	j.timer = time.NewTimer(cacheTime)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []*driver.Config
+	for _, w := range watches {
+		key := hash.KeyString(w.Config)
+		if _, ok := s.watchers[key]; ok {
+			continue
+		}
+		if !w.Deadline.After(time.Now()) {
+			expired = append(expired, w.Config)
+			continue
+		}
+		s.lggr.Debugf("%v: restoring watcher until %v", w.Config.Patterns, w.Deadline)
+		j, err := s.start(key, w.Config, w.Deadline)
+		if err != nil {
+			s.lggr.Errorf("%v: could not restore watcher: %v", w.Config.Patterns, err)
+			continue
+		}
+		j.persisted = w.Deadline
+	}
+	// The watchers of these entries expired while the server was
+	// down. The startup UpdateAll does not verify them again,
+	// so marking them need not block the server.
+	go func() {
+		defer crash.Recover(s.lggr, "expiring restored watchers", nil)
+		for _, cfg := range expired {
+			s.dc.SetWatch(cfg, time.Time{})
+			if err := s.dc.MarkUnverified(cfg, cache.Invalidation{Reason: cache.WatchExpired}); err != nil {
+				s.lggr.Errorf("%v: could not mark unverified: %v", cfg.Patterns, err)
+			}
+			s.opts.Events.Publish(events.Event{Kind: events.WatchExpired, Config: cfg})
+		}
+	}()
+	return nil
+}
+
+func (s *service) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]Status, 0, len(s.watchers))
+	for _, j := range s.watchers {
+		j.mu.Lock()
+		deadline := j.deadline
+		j.mu.Unlock()
+		_, polling := j.w.(*pollNotifier)
+		statuses = append(statuses, Status{
+			Patterns: j.cfg.Patterns,
+			Dir:      j.cfg.Dir,
+			Deadline: deadline,
+			Polling:  polling,
+		})
+	}
+	sort.Slice(statuses, func(i, k int) bool {
+		return statuses[i].Deadline.Before(statuses[k].Deadline)
+	})
+	return statuses
+}
+
+// start creates a job for cfg that expires at deadline.
+// It must be called with s.mu held.
+func (s *service) start(key string, cfg *driver.Config, deadline time.Time) (*job, error) {
+	j := &job{dc: s.dc}
+	j.expiry = s.opts.Expiry
+	j.refreshTimeout = s.opts.RefreshTimeout
+	j.events = s.opts.Events
 	j.lggr = s.lggr
 	j.deleter = s.close
 	j.key = key
 	j.cfg = cfg
-	j.addFiles()
-	j.timer = time.NewTimer(cacheTime)
+	j.filter = newFileFilter(cfg)
+	j.ignore = s.ignore
+	if err := s.addFiles(j); err != nil {
+		return nil, err
+	}
+	if dirs := j.parseDirs(); len(dirs) > 0 {
+		if root := s.ignore.repoRoot(dirs[0]); root != "" {
+			j.repo = s.repo(root)
+		}
+	}
+	j.timer = time.NewTimer(time.Until(deadline))
+	j.deadline = deadline
 	j.extension = make(chan struct{})
+	j.stop = make(chan struct{})
 	s.watchers[key] = j
 	go j.runTimer()
 	go j.runWatcher()
 
-	return nil
+	return j, nil
 }
 
+// Close stops all the jobs without clearing their
+// persisted registrations, so that they can be restored
+// by the next server.
 func (s *service) Close() error {
 	s.mu.Lock()
+	defer s.mu.Unlock()
 	for _, j := range s.watchers {
+		close(j.stop)
 		err := j.w.Close()
 		if err != nil {
 			return err
 		}
 	}
 	s.watchers = map[string]*job{}
-	s.mu.Unlock()
+	for _, r := range s.repos {
+		r.close()
+	}
+	s.repos = map[string]*repoWatcher{}
+	return nil
+}
+
+// addFiles starts the job's notifier on its directories.
+func (s *service) addFiles(j *job) error {
+	dirs := j.parseDirs()
+	w, err := s.notify(dirs)
+	if err != nil {
+		return err
+	}
+	j.w = w
+	for _, dir := range dirs {
+		j.filter.seed(dir)
+	}
 	return nil
 }
 
-func (s *service) close(key string, w *fsnotify.Watcher) {
+// notify returns a notifier watching paths. If native watching is
+// unavailable or fails, for example because the inotify watch limit
+// is exhausted or the files live on a network file system, it falls
+// back to polling.
+func (s *service) notify(paths []string) (notifier, error) {
+	if !s.opts.Poll {
+		w, err := newNativeNotifier()
+		if err == nil {
+			err = addAll(w, paths)
+			if err == nil {
+				return w, nil
+			}
+			w.Close()
+		}
+		s.lggr.Warnf("%v: native watcher failed, falling back to polling: %v", paths, err)
+	}
+	w := newPollNotifier(s.opts.PollInterval)
+	if err := addAll(w, paths); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func addAll(w notifier, paths []string) error {
+	for _, path := range paths {
+		if err := w.Add(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *service) close(key string, w notifier) {
 	s.mu.Lock()
 	w.Close()
+	if j, ok := s.watchers[key]; ok {
+		s.release(j.repo)
+	}
 	delete(s.watchers, key)
 	s.mu.Unlock()
 }
 
 type job struct {
-	w         *fsnotify.Watcher
-	dc        cache.Service
-	key       string
-	cfg       *driver.Config
-	timer     *time.Timer
-	lggr      *logrus.Logger
-	deleter   func(key string, w *fsnotify.Watcher)
-	extension chan struct{}
+	w              notifier
+	dc             cache.Service
+	key            string
+	cfg            *driver.Config
+	filter         *fileFilter
+	ignore         *ignorer
+	repo           *repoWatcher
+	timer          *time.Timer
+	lggr           *logrus.Logger
+	deleter        func(key string, w notifier)
+	extension      chan struct{}
+	stop           chan struct{}
+	expiry         time.Duration
+	refreshTimeout time.Duration
+	events         *events.Bus
+	mu             sync.Mutex
+	deadline       time.Time
+	// persisted is the deadline last written to the cache.
+	persisted time.Time
+	// requestID holds the ID of the latest request for the entry.
+	requestID atomic.Value
 }
 
-const cacheTime = time.Hour
+const defaultExpiry = time.Hour
+
+const defaultRefreshTimeout = 30 * time.Second
+
+// persistInterval bounds how often an extended
+// deadline is written back to the cache.
+const persistInterval = time.Minute
+
+// log returns the job's logger, with the ID
+// of the latest request for its entry.
+func (j *job) log() *logrus.Entry {
+	id, _ := j.requestID.Load().(string)
+	return logging.Entry(j.lggr, id)
+}
 
 func (j *job) extendDeadline() {
-	j.lggr.Debugf("%v: extending deadline", j.cfg.Patterns)
+	j.log().Debugf("%v: extending deadline", j.cfg.Patterns)
 	if !j.timer.Stop() {
 		<-j.timer.C
 	}
-	j.timer.Reset(cacheTime)
+	j.timer.Reset(j.expiry)
+	j.mu.Lock()
+	j.deadline = time.Now().Add(j.expiry)
+	j.mu.Unlock()
+	j.persist()
+}
+
+// persist writes the job's deadline to the cache
+// unless it was written less than persistInterval ago.
+func (j *job) persist() {
+	defer crash.Recover(j.lggr, "persisting a watcher", nil)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.deadline.Sub(j.persisted) < persistInterval {
+		return
+	}
+	if err := j.dc.SetWatch(j.cfg, j.deadline); err != nil {
+		j.log().Errorf("%v: could not persist deadline: %v", j.cfg.Patterns, err)
+		return
+	}
+	j.persisted = j.deadline
 }
 
 func (j *job) requestExtension() {
@@ -122,14 +373,27 @@ func (j *job) requestExtension() {
 }
 
 func (j *job) runTimer() {
+	defer crash.Recover(j.lggr, "running a watcher timer", nil)
 	for {
 		select {
 		case <-j.timer.C:
-			j.lggr.Debugf("%v: expired. Removing watcher", j.cfg.Patterns)
+			j.log().Infof("%v: expired. Removing watcher", j.cfg.Patterns)
+			if err := j.dc.SetWatch(j.cfg, time.Time{}); err != nil {
+				j.log().Errorf("%v: could not clear watcher: %v", j.cfg.Patterns, err)
+			}
+			// Nothing watches the entry anymore, so the
+			// next Get must not trust it blindly.
+			if err := j.dc.MarkUnverified(j.cfg, cache.Invalidation{Reason: cache.WatchExpired}); err != nil {
+				j.log().Errorf("%v: could not mark unverified: %v", j.cfg.Patterns, err)
+			}
+			j.events.Publish(events.Event{Kind: events.WatchExpired, Config: j.cfg})
 			j.deleter(j.key, j.w)
 			return
 		case <-j.extension:
 			j.extendDeadline()
+		case <-j.stop:
+			j.timer.Stop()
+			return
 		}
 	}
 }
@@ -137,49 +401,71 @@ func (j *job) runTimer() {
 func (j *job) runWatcher() {
 	for {
 		select {
-		case event, ok := <-j.w.Events:
-			j.lggr.Debugf("GOT EVENT: %v", event.String())
+		case event, ok := <-j.w.Events():
 			if !ok {
 				return
 			}
-			j.requestExtension()
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				j.lggr.Debugf("%v changed. Updating...", event.Name)
-				ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
-				err := j.dc.Update(ctx, j.cfg)
-				if err != nil {
-					j.lggr.Errorf("error updating %v: %v", event.Name, err)
-				}
-				cancel()
-			}
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				// j.w.Add(event.Name)
-				// TODO: figure out new files -- maybe don't need them.
-			}
-			if event.Op&fsnotify.Rename == fsnotify.Rename {
-				// TODO: figure out renaming
-			}
-		case err, ok := <-j.w.Errors:
+			j.handle(event)
+		case err, ok := <-j.w.Errors():
 			if !ok {
 				return
 			}
-			j.lggr.Errorf("WATCHER ERR: %v", err)
+			j.log().Errorf("WATCHER ERR: %v", err)
+			watchErrors.Inc()
 		}
 	}
 }
 
-func (j *job) addFiles() error {
-	files := j.parseFiles()
+// handle refreshes the job's entry if event can affect it.
+func (j *job) handle(event fsnotify.Event) {
+	defer crash.Recover(j.lggr, "handling "+event.String(), nil)
+	if event.Op == fsnotify.Chmod || j.ignore.ignored(event.Name) {
+		return
+	}
+	j.log().Debugf("GOT EVENT: %v", event.String())
+	if !j.filter.relevant(event.Name) {
+		j.log().Debugf("%v cannot affect %v. Ignoring", event.Name, j.cfg.Patterns)
+		return
+	}
+	j.requestExtension()
+	j.dc.Changed(j.cfg, invalidation(event))
+	if j.repo.deferRefresh() {
+		j.log().Debugf("%v changed while %v is paused. Deferring", event.Name, j.repo.root)
+		return
+	}
+	log := j.log()
+	log.Infof("%v changed. Updating %v", event.Name, j.cfg.Patterns)
+	ctx, cancel := context.WithTimeout(context.Background(), j.refreshTimeout)
+	defer cancel()
+	if id, ok := log.Data[logging.Field].(string); ok {
+		ctx = logging.WithID(ctx, id)
+	}
+	err := j.dc.Update(ctx, j.cfg)
+	if err != nil {
+		log.Errorf("error updating %v: %v", event.Name, err)
+	}
+}
 
-	for _, file := range files {
-		// TODO: stat file or let go/packages handle err?
-		j.lggr.Debugf("adding %v", file)
-		if err := j.w.Add(file); err != nil {
-			return err
-		}
+// invalidation describes the change of a file an entry depends on.
+func invalidation(event fsnotify.Event) cache.Invalidation {
+	reason := cache.FileChanged
+	if base := filepath.Base(event.Name); base == "go.mod" || base == "go.sum" {
+		reason = cache.ModuleChanged
 	}
+	return cache.Invalidation{Reason: reason, Path: event.Name, Op: event.Op.String()}
+}
 
-	return nil
+func (j *job) parseDirs() []string {
+	seen := map[string]bool{}
+	dirs := []string{}
+	for _, file := range j.parseFiles() {
+		dir := filepath.Dir(file)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
 }
 
 func (j *job) parseFiles() []string {